@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type BatchStepType string
+
+const (
+	BatchText   BatchStepType = "text"
+	BatchBinary               = "binary"
+	BatchPing                 = "ping"
+	BatchClose                = "close"
+)
+
+// BatchStep is a line in the file given by --input-file, like:
+//
+//	{"type": "text", "data": "hello", "delay": "500ms", "wait": {"count": 2, "timeout": "3s"}}
+//	{"type": "binary", "data": "SGVsbG8=", "wait": {"match": {"jsonPath": "$.type", "value": "ack"}}}
+//	{"type": "close", "code": 1000, "data": "bye"}
+//
+// Data is sent as is for text and ping, in Base64 for binary and as the reason for close.
+type BatchStep struct {
+	Type  BatchStepType `yaml:"type"`
+	Data  string        `yaml:"data"`
+	Code  int           `yaml:"code"`
+	Delay time.Duration `yaml:"delay"`
+	Wait  *BatchWait    `yaml:"wait"`
+
+	payload []byte
+}
+
+// BatchWait waits after sending a step until Count messages are received, or Count messages
+// matching Match if it's set. Count is 1 when it's not set.
+type BatchWait struct {
+	Count   int             `yaml:"count"`
+	Match   *MessageMatcher `yaml:"match"`
+	Timeout time.Duration   `yaml:"timeout"`
+}
+
+type waitResult int
+
+const (
+	waitSatisfied waitResult = iota
+	waitTimeout
+	waitClosed
+	waitInterrupted
+)
+
+func LoadBatchSteps(path string) ([]*BatchStep, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open input file \"%s\" failed: %s", path, err)
+	}
+	defer file.Close()
+
+	var steps []*BatchStep
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLineSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		// each line is a JSON object, which is also valid YAML so durations like "1s" can be parsed for free
+		var step BatchStep
+		if err := yaml.UnmarshalStrict([]byte(line), &step); err != nil {
+			return nil, fmt.Errorf("parse line %d of \"%s\" failed: %s", lineNo, path, err)
+		}
+		if err := step.compile(); err != nil {
+			return nil, fmt.Errorf("invalid line %d of \"%s\": %s", lineNo, path, err)
+		}
+		if len(steps) > 0 && steps[len(steps)-1].Type == BatchClose {
+			return nil, fmt.Errorf("invalid line %d of \"%s\": nothing can be sent after close", lineNo, path)
+		}
+		steps = append(steps, &step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read input file \"%s\" failed: %s", path, err)
+	}
+	return steps, nil
+}
+
+func (step *BatchStep) compile() error {
+	switch step.Type {
+	case "", BatchText:
+		step.Type = BatchText
+		step.payload = []byte(step.Data)
+	case BatchBinary:
+		var err error
+		if step.payload, err = base64.StdEncoding.DecodeString(step.Data); err != nil {
+			return fmt.Errorf("invalid string in Base64: \"%s\"", step.Data)
+		}
+	case BatchPing:
+		step.payload = []byte(step.Data)
+	case BatchClose:
+		if step.Code == 0 {
+			step.Code = defaultCloseStatusCode
+		}
+		step.payload = websocket.FormatCloseMessage(step.Code, step.Data)
+	default:
+		return fmt.Errorf("unknown message type: \"%s\"", step.Type)
+	}
+
+	if step.Wait != nil {
+		if step.Type == BatchClose {
+			return errors.New("can not wait for messages after close")
+		}
+		if step.Wait.Count <= 0 {
+			step.Wait.Count = 1
+		}
+		if step.Wait.Timeout <= 0 {
+			step.Wait.Timeout = defaultBatchWaitTimeout
+		}
+		if step.Wait.Match != nil {
+			if err := step.Wait.Match.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (step *BatchStep) messageType() int {
+	switch step.Type {
+	case BatchBinary:
+		return websocket.BinaryMessage
+	case BatchPing:
+		return websocket.PingMessage
+	case BatchClose:
+		return websocket.CloseMessage
+	}
+	return websocket.TextMessage
+}
+
+func (w *BatchWait) String() string {
+	if w.Match != nil {
+		return fmt.Sprintf("%d %s", w.Count, w.Match)
+	}
+	return fmt.Sprintf("%d message(s)", w.Count)
+}
+
+// receiveUntil prints received messages until onMessage returns true, the deadline passes,
+// the connection is closed or the user interrupts.
+func (client *Client) receiveUntil(deadline time.Time, interrupt chan os.Signal, onMessage func(*WebSocketMessage) bool) waitResult {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return waitTimeout
+		case message, ok := <-client.readWsChan:
+			if !ok {
+				return waitClosed
+			}
+			PrintReceivedMessage(&message)
+			if client.expectation != nil {
+				client.expectation.observe(&message)
+			}
+			if onMessage(&message) {
+				return waitSatisfied
+			}
+		case <-interrupt:
+			return waitInterrupted
+		}
+	}
+}
+
+// waitFor returns the number of messages received and how many of them matched the wait.
+func (client *Client) waitFor(wait *BatchWait, interrupt chan os.Signal) (waitResult, int, int) {
+	received := 0
+	matched := 0
+	result := client.receiveUntil(time.Now().Add(wait.Timeout), interrupt, func(message *WebSocketMessage) bool {
+		received++
+		if wait.Match != nil {
+			if _, _, ok := wait.Match.match(message.payload); !ok {
+				return false
+			}
+		}
+		matched++
+		return matched >= wait.Count
+	})
+	return result, received, matched
+}
+
+// runBatch sends the steps in the input file one by one and returns the exit code telling whether
+// every wait was satisfied. It goes on after a wait times out and the first failure decides the exit code.
+func (client *Client) runBatch(cliOpts CommandLineOptions) int {
+	steps, err := LoadBatchSteps(cliOpts.InputFile)
+	if err != nil {
+		wsdogLogger.Fatal(err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	neverSatisfied := func(*WebSocketMessage) bool { return false }
+	exitCode := ExitOk
+	for i, step := range steps {
+		if step.Delay > 0 {
+			switch client.receiveUntil(time.Now().Add(step.Delay), interrupt, neverSatisfied) {
+			case waitClosed:
+				wsdogLogger.Errorf("step %d: connection closed before sending", i+1)
+				return client.exitCodeOnClosedInBatch(exitCode)
+			case waitInterrupted:
+				return ExitError
+			}
+		}
+
+		wsdogLogger.Debugf("step %d: send %s message: %s", i+1, step.Type, step.Data)
+		if err := client.tryWriteMessage(step.messageType(), step.payload); err != nil {
+			wsdogLogger.Errorf("step %d: send %s message failed: %s", i+1, step.Type, err)
+			return client.exitCodeOnClosedInBatch(exitCode)
+		}
+
+		if step.Type == BatchClose {
+			// wait for the server to reply the close frame
+			client.receiveUntil(time.Now().Add(defaultWriteWaitDuration), interrupt, neverSatisfied)
+			client.close()
+			return client.exitCodeOnBatchFinish(exitCode, cliOpts, interrupt)
+		}
+
+		if step.Wait == nil {
+			continue
+		}
+		result, received, matched := client.waitFor(step.Wait, interrupt)
+		switch result {
+		case waitTimeout:
+			wsdogLogger.Errorf("step %d: expect %s in %s but got %d", i+1, step.Wait, step.Wait.Timeout, matched)
+			if exitCode == ExitOk && received == 0 {
+				exitCode = ExitTimeout
+			} else if exitCode == ExitOk {
+				exitCode = ExitAssertionFailed
+			}
+		case waitClosed:
+			wsdogLogger.Errorf("step %d: expect %s but connection closed after %d", i+1, step.Wait, matched)
+			return client.exitCodeOnClosedInBatch(exitCode)
+		case waitInterrupted:
+			return ExitError
+		}
+	}
+	return client.exitCodeOnBatchFinish(exitCode, cliOpts, interrupt)
+}
+
+// exitCodeOnBatchFinish waits up to --wait seconds for the expectation given by --expect if
+// it's not met yet after all the steps are sent.
+func (client *Client) exitCodeOnBatchFinish(exitCode int, cliOpts CommandLineOptions, interrupt chan os.Signal) int {
+	if exitCode != ExitOk {
+		return exitCode
+	}
+	if client.expectation == nil || client.expectation.met {
+		return ExitOk
+	}
+	if atomic.LoadUint32(&client.closed) == NormalState {
+		timeout := time.Second * time.Duration(cliOpts.Wait)
+		result := client.receiveUntil(time.Now().Add(timeout), interrupt, func(*WebSocketMessage) bool {
+			return client.expectation.met
+		})
+		if result == waitClosed {
+			return client.exitCodeOnClosed()
+		}
+	}
+	if client.expectation.met {
+		return ExitOk
+	}
+	return client.expectation.failureExitCode()
+}
+
+// exitCodeOnClosedInBatch returns the exit code when the connection was closed in the middle of the steps.
+func (client *Client) exitCodeOnClosedInBatch(exitCode int) int {
+	if exitCode != ExitOk {
+		return exitCode
+	}
+	if code := client.exitCodeOnClosed(); code != ExitOk {
+		return code
+	}
+	// the script is not finished, so there must be something unexpected even the connection was closed normally
+	return ExitAssertionFailed
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadBatchLines(t *testing.T, lines ...string) ([]*BatchStep, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadBatchSteps(path)
+}
+
+func TestLoadBatchSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    BatchStep
+		wantErr string
+	}{
+		{name: "text by default", line: `{"data": "hello", "delay": "500ms"}`,
+			want: BatchStep{Type: BatchText, Delay: 500 * time.Millisecond, payload: []byte("hello")}},
+		{name: "binary", line: `{"type": "binary", "data": "SGVsbG8="}`,
+			want: BatchStep{Type: BatchBinary, payload: []byte("Hello")}},
+		{name: "close with default code", line: `{"type": "close", "data": "bye"}`,
+			want: BatchStep{Type: BatchClose, Code: 1000, payload: []byte("\x03\xe8bye")}},
+		{name: "wait defaults", line: `{"data": "hi", "wait": {}}`,
+			want: BatchStep{Type: BatchText, Wait: &BatchWait{Count: 1, Timeout: defaultBatchWaitTimeout}, payload: []byte("hi")}},
+		{name: "invalid Base64", line: `{"type": "binary", "data": "%%%"}`, wantErr: "invalid string in Base64"},
+		{name: "unknown type", line: `{"type": "pong"}`, wantErr: "unknown message type"},
+		{name: "unknown field", line: `{"data": "hi", "dealy": "1s"}`, wantErr: "parse line 1"},
+		{name: "wait after close", line: `{"type": "close", "wait": {"count": 1}}`, wantErr: "can not wait"},
+		{name: "invalid matcher", line: `{"wait": {"match": {"regex": "("}}}`, wantErr: "invalid line 1"},
+	}
+	for _, test := range tests {
+		steps, err := loadBatchLines(t, test.line)
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		got := steps[0]
+		if got.Type != test.want.Type || got.Code != test.want.Code || got.Delay != test.want.Delay || !bytes.Equal(got.payload, test.want.payload) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+		if (got.Wait == nil) != (test.want.Wait == nil) ||
+			got.Wait != nil && (got.Wait.Count != test.want.Wait.Count || got.Wait.Timeout != test.want.Wait.Timeout) {
+			t.Errorf("%s: got wait %+v, want %+v", test.name, got.Wait, test.want.Wait)
+		}
+	}
+}
+
+func TestLoadBatchStepsAfterClose(t *testing.T) {
+	_, err := loadBatchLines(t, `{"type": "close"}`, ``, `{"data": "hi"}`)
+	if err == nil || !strings.Contains(err.Error(), "invalid line 3") {
+		t.Errorf("got error %v, want the line after close rejected", err)
+	}
+}
+
+func TestBatchWaitFor(t *testing.T) {
+	tests := []struct {
+		name         string
+		wait         string
+		received     []string
+		wantResult   waitResult
+		wantReceived int
+		wantMatched  int
+	}{
+		{name: "any message", wait: `{}`, received: []string{"a", "b"},
+			wantResult: waitSatisfied, wantReceived: 1, wantMatched: 1},
+		{name: "count", wait: `{"count": 2}`, received: []string{"a", "b", "c"},
+			wantResult: waitSatisfied, wantReceived: 2, wantMatched: 2},
+		{name: "exact", wait: `{"match": {"exact": "ack"}}`, received: []string{"a", "ack", "b"},
+			wantResult: waitSatisfied, wantReceived: 2, wantMatched: 1},
+		{name: "regex count", wait: `{"count": 2, "match": {"regex": "^tick \\d+$"}}`, received: []string{"tick 1", "tock", "tick 2"},
+			wantResult: waitSatisfied, wantReceived: 3, wantMatched: 2},
+		{name: "json path", wait: `{"match": {"jsonPath": "$.type", "value": "ack"}}`,
+			received:   []string{`{"type": "hello"}`, `not json`, `{"type": "ack"}`},
+			wantResult: waitSatisfied, wantReceived: 3, wantMatched: 1},
+		{name: "closed before matched", wait: `{"count": 2, "match": {"exact": "ack"}}`, received: []string{"ack", "b"},
+			wantResult: waitClosed, wantReceived: 2, wantMatched: 1},
+	}
+	for _, test := range tests {
+		steps, err := loadBatchLines(t, `{"data": "hi", "wait": `+test.wait+`}`)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		// the connection is closed after the messages are received
+		client := Client{readWsChan: make(chan WebSocketMessage, len(test.received))}
+		for _, payload := range test.received {
+			client.readWsChan <- WebSocketMessage{messageType: websocket.TextMessage, payload: []byte(payload)}
+		}
+		close(client.readWsChan)
+
+		result, received, matched := client.waitFor(steps[0].Wait, make(chan os.Signal))
+		if result != test.wantResult || received != test.wantReceived || matched != test.wantMatched {
+			t.Errorf("%s: got (%d, %d received, %d matched), want (%d, %d received, %d matched)",
+				test.name, result, received, matched, test.wantResult, test.wantReceived, test.wantMatched)
+		}
+	}
+}
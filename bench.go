@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BenchStats collects the results of all the connections in a benchmark.
+type BenchStats struct {
+	mu           sync.Mutex
+	connectTimes []time.Duration
+	roundTrips   []time.Duration
+	failed       int
+	errors       map[string]int
+	closeCodes   map[int]int
+
+	connected int64
+	sent      int64
+	received  int64
+	// lost counts the messages not echoed back within defaultBenchEchoTimeout
+	lost int64
+}
+
+func NewBenchStats() *BenchStats {
+	return &BenchStats{errors: make(map[string]int), closeCodes: make(map[int]int)}
+}
+
+func (s *BenchStats) addConnectTime(d time.Duration) {
+	atomic.AddInt64(&s.connected, 1)
+	s.mu.Lock()
+	s.connectTimes = append(s.connectTimes, d)
+	s.mu.Unlock()
+}
+
+func (s *BenchStats) addRoundTrip(d time.Duration) {
+	s.mu.Lock()
+	s.roundTrips = append(s.roundTrips, d)
+	s.mu.Unlock()
+}
+
+func (s *BenchStats) addError(err string, connectFailed bool) {
+	s.mu.Lock()
+	if connectFailed {
+		s.failed++
+	}
+	s.errors[err]++
+	s.mu.Unlock()
+}
+
+func (s *BenchStats) addCloseCode(code int) {
+	s.mu.Lock()
+	s.closeCodes[code]++
+	s.mu.Unlock()
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func describeDurations(durations []time.Duration) string {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return fmt.Sprintf("min %s, p50 %s, p90 %s, p99 %s, max %s",
+		sorted[0], percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), sorted[len(sorted)-1])
+}
+
+func (s *BenchStats) printSummary(attempted int, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wsdogLogger.Okf("Connections: %d attempted, %d succeeded, %d failed", attempted, len(s.connectTimes), s.failed)
+	if len(s.connectTimes) > 0 {
+		wsdogLogger.Okf("Connect time: %s", describeDurations(s.connectTimes))
+	}
+	if len(s.roundTrips) > 0 {
+		wsdogLogger.Okf("Round trip: %s", describeDurations(s.roundTrips))
+	} else {
+		wsdogLogger.Okf("Round trip: no message echoed back")
+	}
+
+	seconds := elapsed.Seconds()
+	wsdogLogger.Okf("Messages: %d sent (%.1f/s), %d received (%.1f/s), %d lost in %s",
+		s.sent, float64(s.sent)/seconds, s.received, float64(s.received)/seconds, s.lost, elapsed.Round(time.Millisecond))
+
+	if len(s.errors) > 0 {
+		wsdogLogger.Okf("Errors:")
+		errs := make([]string, 0, len(s.errors))
+		for err := range s.errors {
+			errs = append(errs, err)
+		}
+		sort.Strings(errs)
+		for _, err := range errs {
+			wsdogLogger.Okf("  %d x %s", s.errors[err], err)
+		}
+	}
+	if len(s.closeCodes) > 0 {
+		codes := make([]int, 0, len(s.closeCodes))
+		for code := range s.closeCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		var descriptions []string
+		for _, code := range codes {
+			descriptions = append(descriptions, fmt.Sprintf("%d x %d", s.closeCodes[code], code))
+		}
+		wsdogLogger.Okf("Close codes: %s", strings.Join(descriptions, ", "))
+	}
+}
+
+type sentBenchMessage struct {
+	payload string
+	sentAt  time.Time
+}
+
+// benchConn is a connection in a benchmark. It remembers when each message was sent, so
+// a message echoed back by the server tells the round-trip time. Messages not echoed back
+// within defaultBenchEchoTimeout are forgotten and counted as lost.
+type benchConn struct {
+	id      int
+	conn    *websocket.Conn
+	stats   *BenchStats
+	mu      sync.Mutex
+	pending map[string][]time.Time
+	// sent keeps the pending messages in the order they were sent, to find the expired ones
+	sent []sentBenchMessage
+}
+
+// expire drops the pending messages sent before the given time. It must be called with mu held.
+func (c *benchConn) expire(before time.Time) {
+	for len(c.sent) > 0 && c.sent[0].sentAt.Before(before) {
+		m := c.sent[0]
+		c.sent = c.sent[1:]
+		// the message was echoed back already if it's not the oldest pending one of its payload
+		if sentAt := c.pending[m.payload]; len(sentAt) > 0 && sentAt[0].Equal(m.sentAt) {
+			if len(sentAt) > 1 {
+				c.pending[m.payload] = sentAt[1:]
+			} else {
+				delete(c.pending, m.payload)
+			}
+			atomic.AddInt64(&c.stats.lost, 1)
+		}
+	}
+}
+
+func (c *benchConn) send(payload string) error {
+	now := time.Now()
+	c.mu.Lock()
+	c.expire(now.Add(-defaultBenchEchoTimeout))
+	c.pending[payload] = append(c.pending[payload], now)
+	c.sent = append(c.sent, sentBenchMessage{payload, now})
+	c.mu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		return err
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(payload)); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.stats.sent, 1)
+	return nil
+}
+
+func (c *benchConn) onReceived(payload string) {
+	atomic.AddInt64(&c.stats.received, 1)
+
+	c.mu.Lock()
+	c.expire(time.Now().Add(-defaultBenchEchoTimeout))
+	sentAt, ok := c.pending[payload]
+	if ok {
+		if len(sentAt) > 1 {
+			c.pending[payload] = sentAt[1:]
+		} else {
+			delete(c.pending, payload)
+		}
+	}
+	c.mu.Unlock()
+	if ok {
+		c.stats.addRoundTrip(time.Since(sentAt[0]))
+	}
+}
+
+// readUntilClosed reads until the connection is closed and records how it was closed.
+func (c *benchConn) readUntilClosed(closing *int32) {
+	for {
+		_, payload, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				c.stats.addCloseCode(closeErr.Code)
+			} else if atomic.LoadInt32(closing) == 0 {
+				c.stats.addError(fmt.Sprintf("read: %s", err), false)
+			}
+			return
+		}
+		c.onReceived(string(payload))
+	}
+}
+
+// countLost counts the messages still pending when the connection is closed as lost.
+func (c *benchConn) countLost() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for payload, sentAt := range c.pending {
+		atomic.AddInt64(&c.stats.lost, int64(len(sentAt)))
+		delete(c.pending, payload)
+	}
+	c.sent = nil
+}
+
+func renderBenchMessage(template string, connId int, seq int) string {
+	return strings.NewReplacer(
+		"{{conn}}", strconv.Itoa(connId),
+		"{{seq}}", strconv.Itoa(seq),
+		"{{time}}", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+	).Replace(template)
+}
+
+func runBenchConn(id int, dialer websocket.Dialer, connectUrl *url.URL, headers http.Header, cliOpts CommandLineOptions, stats *BenchStats, stop chan struct{}) {
+	start := time.Now()
+	conn, resp, err := dialer.Dial(connectUrl.String(), headers)
+	if err != nil {
+		if err == websocket.ErrBadHandshake && resp != nil {
+			stats.addError(fmt.Sprintf("connect: %s (status: %s)", err, resp.Status), true)
+		} else {
+			stats.addError(fmt.Sprintf("connect: %s", describeTlsError(err)), true)
+		}
+		return
+	}
+	stats.addConnectTime(time.Since(start))
+
+	c := benchConn{id: id, conn: conn, stats: stats, pending: make(map[string][]time.Time)}
+	defer c.countLost()
+	var closing int32
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		c.readUntilClosed(&closing)
+	}()
+
+	deadline := time.NewTimer(cliOpts.BenchDuration)
+	defer deadline.Stop()
+	var tick <-chan time.Time
+	if cliOpts.BenchRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cliOpts.BenchRate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for seq := 1; ; seq++ {
+		select {
+		case <-tick:
+			if err := c.send(renderBenchMessage(cliOpts.BenchMessage, id, seq)); err != nil {
+				stats.addError(fmt.Sprintf("write: %s", err), false)
+				closeConn(conn)
+				<-readDone
+				return
+			}
+			continue
+		case <-readDone:
+			closeConn(conn)
+			return
+		case <-deadline.C:
+		case <-stop:
+		}
+		break
+	}
+
+	// close normally and wait for the server to reply the close frame
+	atomic.StoreInt32(&closing, 1)
+	message := websocket.FormatCloseMessage(defaultCloseStatusCode, defaultCloseReason)
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		wsdogLogger.Debugf("connection %d: write close frame failed: %s", id, err)
+	}
+	select {
+	case <-readDone:
+	case <-time.After(defaultWriteWaitDuration):
+	}
+	closeConn(conn)
+}
+
+// RunBench opens --bench connections to the server at --bench-ramp-up rate, sends messages on each
+// connection at --bench-rate for --bench-duration, then prints a summary of the results.
+func RunBench(url string, cliOpts CommandLineOptions) {
+	if cliOpts.BenchRate < 0 || cliOpts.BenchRampUp < 0 {
+		wsdogLogger.Fatal("--bench-rate and --bench-ramp-up can not be negative")
+	}
+
+	dialer := newDialer(cliOpts)
+	connectUrl := parseConnectUrl(url)
+	headers := buildConnectHeaders(cliOpts)
+	stats := NewBenchStats()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	stop := make(chan struct{})
+
+	wsdogLogger.Okf("Benchmarking %s with %d connections for %s (press CTRL+C to stop)", connectUrl, cliOpts.BenchConnections, cliOpts.BenchDuration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	attempted := 0
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	progress := time.NewTicker(time.Second)
+	progressDone := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-progress.C:
+				wsdogLogger.Okf("%d connected, %d sent, %d received",
+					atomic.LoadInt64(&stats.connected), atomic.LoadInt64(&stats.sent), atomic.LoadInt64(&stats.received))
+			case <-progressDone:
+				return
+			}
+		}
+	}()
+
+ramp:
+	for i := 1; i <= cliOpts.BenchConnections; i++ {
+		if cliOpts.BenchRampUp > 0 && i > 1 {
+			select {
+			case <-time.After(time.Duration(float64(time.Second) / cliOpts.BenchRampUp)):
+			case <-stop:
+				break ramp
+			}
+		}
+		attempted++
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runBenchConn(id, dialer, connectUrl, headers, cliOpts, stats, stop)
+		}(i)
+	}
+	wg.Wait()
+	progress.Stop()
+	close(progressDone)
+
+	stats.printSummary(attempted, time.Since(start))
+	if len(stats.connectTimes) == 0 {
+		os.Exit(ExitConnectFailed)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBenchConnExpire(t *testing.T) {
+	stats := NewBenchStats()
+	c := benchConn{stats: stats, pending: make(map[string][]time.Time)}
+	start := time.Now()
+	for i, payload := range []string{"a", "b", "a", "c"} {
+		sentAt := start.Add(time.Duration(i) * time.Second)
+		c.pending[payload] = append(c.pending[payload], sentAt)
+		c.sent = append(c.sent, sentBenchMessage{payload, sentAt})
+	}
+	// "b" was echoed back
+	delete(c.pending, "b")
+
+	c.expire(start.Add(2500 * time.Millisecond))
+	if stats.lost != 2 {
+		t.Errorf("lost = %d, want 2", stats.lost)
+	}
+	if len(c.sent) != 1 || c.sent[0].payload != "c" {
+		t.Errorf("sent = %v, want only c", c.sent)
+	}
+	if _, ok := c.pending["a"]; ok {
+		t.Errorf("a is still pending")
+	}
+
+	c.countLost()
+	if stats.lost != 3 {
+		t.Errorf("lost = %d, want 3", stats.lost)
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("pending = %v, want none", c.pending)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	Base64Format    = "base64"
+	HexFormat       = "hex"
+	HexdumpFormat   = "hexdump"
+	Utf8LossyFormat = "utf8-lossy"
+)
+
+// formatBinary renders the payload of a Binary Message for display.
+func formatBinary(payload []byte, format string) string {
+	switch format {
+	case HexFormat:
+		return hex.EncodeToString(payload)
+	case HexdumpFormat:
+		return hexdump(payload)
+	case Utf8LossyFormat:
+		return strings.ToValidUTF8(string(payload), string(utf8.RuneError))
+	}
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// hexdump renders the payload like xxd, with the offset, the bytes in hex and the
+// printable ASCII characters in each line. Lines after the first one start on a new line.
+func hexdump(payload []byte) string {
+	var sb strings.Builder
+	for offset := 0; offset < len(payload); offset += hexdumpBytesPerLine {
+		end := offset + hexdumpBytesPerLine
+		if end > len(payload) {
+			end = len(payload)
+		}
+		line := payload[offset:end]
+
+		sb.WriteString("\n")
+		sb.WriteString(fmt.Sprintf("%08x: ", offset))
+		for i := 0; i < hexdumpBytesPerLine; i++ {
+			if i < len(line) {
+				sb.WriteString(fmt.Sprintf("%02x", line[i]))
+			} else {
+				sb.WriteString("  ")
+			}
+			if i%2 == 1 {
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString(" ")
+		for _, b := range line {
+			if b >= 0x20 && b < 0x7f {
+				sb.WriteByte(b)
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+	}
+	return sb.String()
+}
+
+// parseHexInput parses bytes in hex like "48656c6c6f", "48 65 6c 6c 6f" or "0x48656c6c6f".
+func parseHexInput(input string) ([]byte, error) {
+	s := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(input), "0x"), "0X")
+	s = strings.Join(strings.Fields(s), "")
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid string in hex: \"%s\"", input)
+	}
+	return bs, nil
+}
+
+// parseEscapedBytes parses a string with escape sequences like "Hello\x00\xff\r\n". Supported escape
+// sequences are \xHH, \n, \r, \t, \0 and \\. Other characters are taken as their UTF-8 bytes.
+func parseEscapedBytes(input string) ([]byte, error) {
+	var bs []byte
+	for i := 0; i < len(input); i++ {
+		if input[i] != '\\' {
+			bs = append(bs, input[i])
+			continue
+		}
+
+		i++
+		if i >= len(input) {
+			return nil, fmt.Errorf("invalid escape sequence at the end of \"%s\"", input)
+		}
+		switch input[i] {
+		case 'x':
+			if i+2 >= len(input) {
+				return nil, fmt.Errorf("invalid escape sequence \"\\x%s\" in \"%s\"", input[i+1:], input)
+			}
+			b, err := hex.DecodeString(input[i+1 : i+3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape sequence \"\\x%s\" in \"%s\"", input[i+1:i+3], input)
+			}
+			bs = append(bs, b[0])
+			i += 2
+		case 'n':
+			bs = append(bs, '\n')
+		case 'r':
+			bs = append(bs, '\r')
+		case 't':
+			bs = append(bs, '\t')
+		case '0':
+			bs = append(bs, 0)
+		case '\\':
+			bs = append(bs, '\\')
+		default:
+			return nil, fmt.Errorf("unknown escape sequence \"\\%c\" in \"%s\"", input[i], input)
+		}
+	}
+	return bs, nil
+}
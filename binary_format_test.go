@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseEscapedBytes(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []byte
+		wantErr bool
+	}{
+		{input: "Hello", want: []byte("Hello")},
+		{input: "", want: nil},
+		{input: `Hello\x00\xff\r\n`, want: []byte("Hello\x00\xff\r\n")},
+		{input: `\xAb`, want: []byte{0xab}},
+		{input: `\t\0\\`, want: []byte{'\t', 0, '\\'}},
+		{input: "héllo", want: []byte("héllo")},
+		{input: `\`, wantErr: true},
+		{input: `abc\`, wantErr: true},
+		{input: `\x4`, wantErr: true},
+		{input: `\x`, wantErr: true},
+		{input: `\xzz`, wantErr: true},
+		{input: `\q`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseEscapedBytes(test.input)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseEscapedBytes(%q) = %v, want error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEscapedBytes(%q) failed: %s", test.input, err)
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("parseEscapedBytes(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseHexInput(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []byte
+		wantErr bool
+	}{
+		{input: "48656c6c6f", want: []byte("Hello")},
+		{input: "48 65 6c 6c 6f", want: []byte("Hello")},
+		{input: " 0x48656C6C6F ", want: []byte("Hello")},
+		{input: "0X00ff", want: []byte{0, 0xff}},
+		{input: "486", wantErr: true},
+		{input: "hello", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseHexInput(test.input)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseHexInput(%q) = %v, want error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHexInput(%q) failed: %s", test.input, err)
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("parseHexInput(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestFormatBinary(t *testing.T) {
+	payload := []byte("Hello, World!\x00\x01\xff\x01\x02")
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"", "SGVsbG8sIFdvcmxkIQAB/wEC"},
+		{Base64Format, "SGVsbG8sIFdvcmxkIQAB/wEC"},
+		{HexFormat, "48656c6c6f2c20576f726c64210001ff0102"},
+		{HexdumpFormat, "\n00000000: 4865 6c6c 6f2c 2057 6f72 6c64 2100 01ff  Hello, World!..." +
+			"\n00000010: 0102                                     .."},
+		{Utf8LossyFormat, "Hello, World!\x00\x01�\x01\x02"},
+	}
+	for _, test := range tests {
+		if got := formatBinary(payload, test.format); got != test.want {
+			t.Errorf("formatBinary(%q) = %q, want %q", test.format, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+)
+
+const (
+	RoomByNone  = "none"
+	RoomByPath  = "path"
+	RoomByQuery = "query"
+
+	// roomQueryParameter is the query parameter naming the room with --room-by query
+	roomQueryParameter = "room"
+)
+
+// roomOf returns the room of a request to a chat route. Clients on the same route are in the
+// same room unless they are grouped by --room-by, which also applies to the path of the route.
+func roomOf(route *Route, r *http.Request, roomBy string) string {
+	switch roomBy {
+	case RoomByPath:
+		return r.URL.Path
+	case RoomByQuery:
+		if room := r.URL.Query().Get(roomQueryParameter); len(room) > 0 {
+			if route.path != "/" {
+				return route.path + "?" + roomQueryParameter + "=" + room
+			}
+			return room
+		}
+	}
+	if route.path != "/" {
+		return route.path
+	}
+	return ""
+}
+
+// hubClient is a client in a ChatHub. Messages relayed to it are queued and written by its own
+// goroutine, so a client which doesn't read fast enough can't block the others.
+type hubClient struct {
+	conn     *ServerConn
+	room     string
+	queue    chan WebSocketMessage
+	kickOnce sync.Once
+}
+
+func (c *hubClient) writeLoop() {
+	for message := range c.queue {
+		if err := c.conn.writeMessage(message.messageType, message.payload); err != nil {
+			wsdogLogger.Errorf("relay to client %d failed: %s", c.conn.id, err)
+			c.kick(websocket.CloseAbnormalClosure, "")
+			return
+		}
+	}
+}
+
+// kick drops a client whose queue is full, or whose connection is broken if code is 1006.
+func (c *hubClient) kick(code int, reason string) {
+	c.kickOnce.Do(func() {
+		go func() {
+			if code != websocket.CloseAbnormalClosure {
+				message := websocket.FormatCloseMessage(code, reason)
+				if err := c.conn.writeControl(websocket.CloseMessage, message); err != nil {
+					wsdogLogger.Debugf("write close frame to connection %d failed: %s", c.conn.id, err)
+				}
+			}
+			closeConn(c.conn.conn)
+		}()
+	})
+}
+
+// ChatHub relays every message received from a client to all the other clients in the same room.
+type ChatHub struct {
+	mu      sync.Mutex
+	rooms   map[string]map[uint64]*hubClient
+	clients map[uint64]*hubClient
+}
+
+func NewChatHub() *ChatHub {
+	return &ChatHub{rooms: make(map[string]map[uint64]*hubClient), clients: make(map[uint64]*hubClient)}
+}
+
+func describeRoom(room string, clients int) string {
+	if len(room) == 0 {
+		return fmt.Sprintf("the chat (%d client(s))", clients)
+	}
+	return fmt.Sprintf("room %s (%d client(s))", room, clients)
+}
+
+func (h *ChatHub) join(conn *ServerConn, room string) {
+	c := &hubClient{conn: conn, room: room, queue: make(chan WebSocketMessage, chatHubQueueSize)}
+	go c.writeLoop()
+
+	h.mu.Lock()
+	clients, ok := h.rooms[room]
+	if !ok {
+		clients = make(map[uint64]*hubClient)
+		h.rooms[room] = clients
+	}
+	clients[conn.id] = c
+	h.clients[conn.id] = c
+	count := len(clients)
+	h.mu.Unlock()
+
+	wsdogLogger.Okf("Client %d joined %s", conn.id, describeRoom(room, count))
+}
+
+func (h *ChatHub) leave(conn *ServerConn) {
+	h.mu.Lock()
+	c, ok := h.clients[conn.id]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.clients, conn.id)
+	// the client is not in the room any more if it was too slow
+	clients := h.rooms[c.room]
+	delete(clients, conn.id)
+	if len(clients) == 0 {
+		delete(h.rooms, c.room)
+	}
+	count := len(clients)
+	close(c.queue)
+	h.mu.Unlock()
+
+	wsdogLogger.Okf("Client %d left %s", conn.id, describeRoom(c.room, count))
+}
+
+// relay queues the message to the other clients in the room of the sender. A client whose queue
+// is full is removed from the room and disconnected, rather than waited for.
+func (h *ChatHub) relay(from *ServerConn, message *WebSocketMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sender, ok := h.clients[from.id]
+	if !ok {
+		return
+	}
+	for id, c := range h.rooms[sender.room] {
+		if id == from.id {
+			continue
+		}
+		select {
+		case c.queue <- *message:
+		default:
+			wsdogLogger.Errorf("client %d is too slow to receive relayed messages, disconnecting", id)
+			delete(h.rooms[sender.room], id)
+			c.kick(websocket.ClosePolicyViolation, "too slow")
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"net/http"
@@ -12,6 +12,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -42,15 +43,16 @@ func parseConnectUrl(urlStr string) *url.URL {
 }
 
 func newDialer(cliOpts CommandLineOptions) websocket.Dialer {
-	var tlsConfig = tls.Config{}
-	if cliOpts.NoTlsCheck {
-		tlsConfig.InsecureSkipVerify = true
+	tlsConfig, err := newClientTlsConfig(cliOpts)
+	if err != nil {
+		wsdogLogger.Fatalf("setup TLS failed: %s", err)
 	}
 	return websocket.Dialer{
-		TLSClientConfig:  &tlsConfig,
-		Subprotocols:     []string{cliOpts.Subprotocol},
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: defaultHandshakeTimeout,
+		TLSClientConfig:   tlsConfig,
+		Subprotocols:      subprotocolList(cliOpts),
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  defaultHandshakeTimeout,
+		EnableCompression: cliOpts.Compression,
 	}
 }
 
@@ -90,16 +92,32 @@ type Client struct {
 	readWsDoneChan chan struct{}
 	enableSlash    bool
 	closed         ClientState
+	dialer         websocket.Dialer
+	connectUrl     *url.URL
+	headers        http.Header
+	cliOpts        CommandLineOptions
+	expectation    *Expectation
+	closeCode      int
+	// writeMu serializes writes of messages and raw frames, like ServerConn.writeMu
+	writeMu sync.Mutex
 }
 
 type CommandType string
 
 const (
-	PingCommand   CommandType = "ping"
-	PongCommand               = "pong"
-	BinaryCommand             = "binary"
-	TextCommand               = "text"
-	CloseCommand              = "close"
+	PingCommand    CommandType = "ping"
+	PongCommand                = "pong"
+	PingHexCommand             = "ping-hex"
+	PongHexCommand             = "pong-hex"
+	FrameCommand               = "frame"
+	BinaryCommand              = "binary"
+	HexCommand                 = "hex"
+	BytesCommand               = "bytes"
+	ProtoCommand               = "proto"
+	MsgpackCommand             = "msgpack"
+	CborCommand                = "cbor"
+	TextCommand                = "text"
+	CloseCommand               = "close"
 )
 
 type ConsoleCommand struct {
@@ -108,14 +126,22 @@ type ConsoleCommand struct {
 }
 
 func (client *Client) doWriteMessage(messageType int, message []byte) {
-	if err := client.conn.SetWriteDeadline(time.Now().Add(defaultWriteWaitDuration)); err != nil {
+	if err := client.tryWriteMessage(messageType, message); err != nil {
 		panic(err)
 	}
+}
 
-	err := client.conn.WriteMessage(messageType, message)
-	if err != nil {
-		panic(err)
+func (client *Client) tryWriteMessage(messageType int, message []byte) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	if err := client.conn.SetWriteDeadline(time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		return err
+	}
+	if err := client.conn.WriteMessage(messageType, message); err != nil {
+		return err
 	}
+	wsdogEvents.Sent(0, messageType, message)
+	return nil
 }
 
 func parseConsoleCommand(input string, enableSlash bool) (*ConsoleCommand, error) {
@@ -142,9 +168,30 @@ func (client *Client) writeMessage(input string) bool {
 	}
 	switch slashCmd.command {
 	case PingCommand:
-		client.doWriteMessage(websocket.PingMessage, nil)
+		client.writeControlMessage(websocket.PingMessage, []byte(slashCmd.parameter))
 	case PongCommand:
-		client.doWriteMessage(websocket.PongMessage, nil)
+		client.writeControlMessage(websocket.PongMessage, []byte(slashCmd.parameter))
+	case PingHexCommand, PongHexCommand:
+		bs, err := parseHexInput(slashCmd.parameter)
+		if err != nil {
+			wsdogLogger.Error(err)
+			break
+		}
+		if slashCmd.command == PingHexCommand {
+			client.writeControlMessage(websocket.PingMessage, bs)
+		} else {
+			client.writeControlMessage(websocket.PongMessage, bs)
+		}
+	case FrameCommand:
+		frame, err := ParseRawFrame(slashCmd.parameter)
+		if err != nil {
+			wsdogLogger.Error(err)
+			break
+		}
+		wsdogLogger.Debugf("write raw %s", frame)
+		if err := writeRawFrame(client.conn, &client.writeMu, 0, frame, true); err != nil {
+			panic(err)
+		}
 	case TextCommand:
 		client.doWriteMessage(websocket.TextMessage, []byte(slashCmd.parameter))
 	case BinaryCommand:
@@ -157,6 +204,36 @@ func (client *Client) writeMessage(input string) bool {
 			break
 		}
 		client.doWriteMessage(websocket.BinaryMessage, sDec)
+	case HexCommand:
+		if len(slashCmd.parameter) == 0 {
+			break
+		}
+		bs, err := parseHexInput(slashCmd.parameter)
+		if err != nil {
+			wsdogLogger.Error(err)
+			break
+		}
+		client.doWriteMessage(websocket.BinaryMessage, bs)
+	case BytesCommand:
+		if len(slashCmd.parameter) == 0 {
+			break
+		}
+		bs, err := parseEscapedBytes(slashCmd.parameter)
+		if err != nil {
+			wsdogLogger.Error(err)
+			break
+		}
+		client.doWriteMessage(websocket.BinaryMessage, bs)
+	case ProtoCommand:
+		if client.cliOpts.protoCodec == nil {
+			wsdogLogger.Error("/proto requires --proto-descriptor and --proto-type")
+			break
+		}
+		client.writeEncodedMessage(client.cliOpts.protoCodec, slashCmd.parameter)
+	case MsgpackCommand:
+		client.writeEncodedMessage(&MsgpackCodec{}, slashCmd.parameter)
+	case CborCommand:
+		client.writeEncodedMessage(&CborCodec{}, slashCmd.parameter)
 	case CloseCommand:
 		statusCode := defaultCloseStatusCode
 		reason := defaultCloseReason
@@ -184,7 +261,26 @@ func (client *Client) writeMessage(input string) bool {
 	return false
 }
 
-func (client *Client) executeCommandThenShutdown(cliOpts CommandLineOptions) {
+// writeControlMessage writes a ping or a pong after checking the size limit of control frames.
+func (client *Client) writeControlMessage(messageType int, payload []byte) {
+	if len(payload) > maxControlFramePayloadSize {
+		wsdogLogger.Errorf("payload of control frames can not exceed %d bytes but got %d bytes. Use /frame to send it anyway", maxControlFramePayloadSize, len(payload))
+		return
+	}
+	client.doWriteMessage(messageType, payload)
+}
+
+// writeEncodedMessage encodes the input in JSON with the codec and writes it as a Binary Message.
+func (client *Client) writeEncodedMessage(codec PayloadCodec, input string) {
+	bs, err := codec.Encode([]byte(input))
+	if err != nil {
+		wsdogLogger.Error(err)
+		return
+	}
+	client.doWriteMessage(websocket.BinaryMessage, bs)
+}
+
+func (client *Client) executeCommandThenShutdown(cliOpts CommandLineOptions) int {
 	client.writeMessage(cliOpts.ExecuteCommand)
 
 	timout := time.Second * time.Duration(cliOpts.Wait)
@@ -196,18 +292,42 @@ func (client *Client) executeCommandThenShutdown(cliOpts CommandLineOptions) {
 	for {
 		select {
 		case <-ticker.C:
-			return
+			return client.exitCodeOnFinish()
 		case message, ok := <-client.readWsChan:
 			if !ok {
-				return
+				return client.exitCodeOnClosed()
 			}
 			PrintReceivedMessage(&message)
+			if client.expectation != nil && client.expectation.observe(&message) {
+				return ExitOk
+			}
 		case <-interrupt:
-			return
+			return client.exitCodeOnFinish()
 		}
 	}
 }
 
+// exitCodeOnFinish returns the exit code when the run finished with the connection still open.
+func (client *Client) exitCodeOnFinish() int {
+	if client.expectation != nil && !client.expectation.met {
+		return client.expectation.failureExitCode()
+	}
+	return ExitOk
+}
+
+// exitCodeOnClosed returns the exit code when the connection was closed before the run finished.
+func (client *Client) exitCodeOnClosed() int {
+	if !isExpectedCloseCode(client.closeCode) {
+		wsdogLogger.Errorf("connection closed unexpectedly with code %d", client.closeCode)
+		return ExitUnexpectedClose
+	}
+	if client.expectation != nil && !client.expectation.met {
+		wsdogLogger.Errorf("expectation failed: %s not received before the connection closed", client.expectation.matcher)
+		return ExitAssertionFailed
+	}
+	return ExitOk
+}
+
 func (client *Client) loopExecuteCommandFromConsole(cliOpts CommandLineOptions) {
 	consoleReader := NewConsoleInputReader()
 	defer consoleReader.Close()
@@ -227,7 +347,16 @@ func (client *Client) loopExecuteCommandFromConsole(cliOpts CommandLineOptions)
 			}
 		case message, ok := <-client.readWsChan:
 			if !ok {
-				return
+				if !cliOpts.Reconnect {
+					return
+				}
+				consoleReader.Clean()
+				reconnected := client.reconnect(interrupt)
+				consoleReader.Refresh()
+				if !reconnected {
+					return
+				}
+				continue
 			}
 			consoleReader.Clean()
 			PrintReceivedMessage(&message)
@@ -238,12 +367,19 @@ func (client *Client) loopExecuteCommandFromConsole(cliOpts CommandLineOptions)
 	}
 }
 
-func (client *Client) run(cliOpts CommandLineOptions) {
+// run returns the exit code telling whether the messages received met expectations.
+func (client *Client) run(cliOpts CommandLineOptions) int {
+	if len(cliOpts.InputFile) > 0 {
+		return client.runBatch(cliOpts)
+	}
+	if len(cliOpts.Replay) > 0 {
+		return client.runReplay(cliOpts)
+	}
 	if len(cliOpts.ExecuteCommand) > 0 {
-		client.executeCommandThenShutdown(cliOpts)
-	} else {
-		client.loopExecuteCommandFromConsole(cliOpts)
+		return client.executeCommandThenShutdown(cliOpts)
 	}
+	client.loopExecuteCommandFromConsole(cliOpts)
+	return ExitOk
 }
 
 func (client *Client) close() {
@@ -262,39 +398,92 @@ func (client *Client) gracefulClose() {
 	}
 	// Cleanly close the connection by sending a close message and then
 	// waiting (with timeout) for the server to close the connection.
-	client.doWriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	// The server may have dropped the connection already, so failing to write is fine here.
+	if err := client.tryWriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+		wsdogLogger.Debugf("write close frame failed: %s", err.Error())
+	}
 	close(client.readWsDoneChan)
 	if err := client.conn.Close(); err != nil {
 		wsdogLogger.Debugf("close client failed: %s", err.Error())
 	}
 }
 
-func checkResponseSubprotocol(requiredProtocol string, resp *http.Response) {
-	subProtoHeader := resp.Header[http.CanonicalHeaderKey(subprotocolHeader)]
-	if len(subProtoHeader) < 1 || subProtoHeader[0] != requiredProtocol {
-		wsdogLogger.Fatal("error: Server sent no subprotocol")
+// connect dials the server and starts reading from the new connection.
+func (client *Client) connect() error {
+	conn, resp, err := client.dialer.Dial(client.connectUrl.String(), client.headers)
+	if client.cliOpts.VerboseHandshake && resp != nil {
+		printHandshake(resp)
+	}
+	if err != nil {
+		if err == websocket.ErrBadHandshake && resp != nil {
+			return &connectError{client.connectUrl.String(), fmt.Errorf("%s (status: %s)", err, resp.Status), true}
+		}
+		return &connectError{client.connectUrl.String(), errors.New(describeTlsError(err)), false}
+	}
+
+	if len(client.dialer.Subprotocols) > 0 {
+		chosen, err := checkResponseSubprotocol(client.dialer.Subprotocols, client.cliOpts.StrictSubprotocol, resp)
+		if err != nil {
+			closeConn(conn)
+			return &connectError{client.connectUrl.String(), err, true}
+		}
+		if len(chosen) > 0 {
+			wsdogLogger.Okf("Server chose subprotocol %s", chosen)
+		} else {
+			wsdogLogger.Okf("Server chose no subprotocol")
+		}
+	}
+
+	if client.cliOpts.Compression {
+		reportNegotiatedExtensions(resp)
+		if err := conn.SetCompressionLevel(client.cliOpts.CompressionLevel); err != nil {
+			closeConn(conn)
+			return &connectError{client.connectUrl.String(), fmt.Errorf("set compression level failed: %s", err), false}
+		}
 	}
+
+	wsdogEvents.Connected(0, conn.RemoteAddr().String())
+	client.conn = conn
+	client.closeCode = 0
+	client.readWsChan, client.readWsDoneChan = SetupReadFromConn(conn, 0, client.cliOpts.ShowPingPong, newKeepalive(client.cliOpts.PingInterval, client.cliOpts.PongTimeout), func(code int, text string) {
+		client.closeCode = code
+	})
+	atomic.StoreUint32(&client.closed, NormalState)
+	return nil
 }
 
 func RunAsClient(url string, cliOpts CommandLineOptions) {
-	connectUrl := parseConnectUrl(url)
-
-	dialer := newDialer(cliOpts)
-	headers := buildConnectHeaders(cliOpts)
+	client := Client{
+		enableSlash: cliOpts.EnableSlash,
+		dialer:      newDialer(cliOpts),
+		connectUrl:  parseConnectUrl(url),
+		headers:     buildConnectHeaders(cliOpts),
+		cliOpts:     cliOpts,
+	}
 
-	conn, resp, err := dialer.Dial(connectUrl.String(), headers)
+	expectation, err := NewExpectation(cliOpts)
 	if err != nil {
-		wsdogLogger.Fatalf("connect to \"%s\" failed with error: \"%s\"", connectUrl, err)
+		wsdogLogger.Fatal(err)
+	}
+	client.expectation = expectation
+	if cliOpts.Compression {
+		if canSniffFrames(client.connectUrl) {
+			client.dialer.NetDial = dialFrameSniffer
+		} else {
+			wsdogLogger.Okf("Sizes of received messages on the wire are not available over wss:// or a proxy")
+		}
 	}
 
-	if len(cliOpts.Subprotocol) > 0 {
-		checkResponseSubprotocol(cliOpts.Subprotocol, resp)
+	if err := client.connect(); err != nil {
+		wsdogLogger.Error(err)
+		os.Exit(connectExitCode(err))
 	}
 
 	wsdogLogger.Ok("Connected (press CTRL+C to quit)")
 
-	readWsChan, readWsDoneChan := SetupReadFromConn(conn, cliOpts.ShowPingPong)
-	client := Client{conn, readWsChan, readWsDoneChan, cliOpts.EnableSlash, NormalState}
-	defer client.gracefulClose()
-	client.run(cliOpts)
+	exitCode := client.run(cliOpts)
+	client.gracefulClose()
+	if exitCode != ExitOk {
+		os.Exit(exitCode)
+	}
 }
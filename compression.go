@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const extensionsHeader = "Sec-WebSocket-Extensions"
+
+func reportNegotiatedExtensions(resp *http.Response) {
+	extensions := resp.Header.Values(extensionsHeader)
+	if len(extensions) == 0 {
+		wsdogLogger.Okf("No extension negotiated, messages will not be compressed")
+		return
+	}
+	wsdogLogger.Okf("Negotiated extensions: %s", strings.Join(extensions, ", "))
+}
+
+// hasPermessageDeflate returns whether permessage-deflate is in the extensions of the headers of
+// a handshake.
+func hasPermessageDeflate(header http.Header) bool {
+	for _, value := range header.Values(extensionsHeader) {
+		for _, extension := range strings.Split(value, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveSniffingFrames serves like server.ListenAndServe does, but sniffs the frames of every
+// connection to tell how they are compressed. Frames can't be sniffed under TLS without hiding the
+// TLS connection from the server, so it's only used without TLS.
+func serveSniffingFrames(server *http.Server) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(frameSniffingListener{ln})
+}
+
+func printWireStats(connId uint64, stats *MessageWireStats, size int) {
+	prefix := connPrefix(connId)
+	if stats.compressed {
+		wsdogLogger.Okf("%s(compressed: %d bytes on the wire, %d bytes decompressed)", prefix, stats.wireSize, size)
+	} else {
+		wsdogLogger.Okf("%s(not compressed: %d bytes on the wire)", prefix, stats.wireSize)
+	}
+}
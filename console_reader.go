@@ -68,3 +68,26 @@ func NewConsoleInputReader() *ConsoleInputReader {
 
 	return &r
 }
+
+// ReadPassphraseFromConsole prompts on the console and reads a line without echoing it.
+func ReadPassphraseFromConsole(prompt string) (string, error) {
+	cancelableStdin := readline.NewCancelableStdin(os.Stdin)
+	reader, err := readline.NewEx(&readline.Config{Stdin: cancelableStdin})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := cancelableStdin.Close(); err != nil {
+			wsdogLogger.Debugf("close cancelable stdin failed: %s", err.Error())
+		}
+		if err := reader.Close(); err != nil {
+			wsdogLogger.Debugf("close input reader failed: %s", err.Error())
+		}
+	}()
+
+	passphrase, err := reader.ReadPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	return string(passphrase), nil
+}
@@ -8,3 +8,13 @@ const defaultReadWaitDuration = 5 * time.Second
 const defaultCloseStatusCode = 1000
 const defaultCloseReason = ""
 const subprotocolHeader = "Sec-WebSocket-Protocol"
+const defaultSelfSignedCertValidity = 24 * time.Hour
+const defaultReconnectBackoff = time.Second
+const defaultBatchWaitTimeout = 5 * time.Second
+const maxBatchLineSize = 1024 * 1024
+const prettyJsonIndent = "  "
+const hexdumpBytesPerLine = 16
+const maxControlFramePayloadSize = 125
+const chatHubQueueSize = 256
+const defaultExecKillTimeout = 3 * time.Second
+const defaultBenchEchoTimeout = 5 * time.Second
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// EventSink receives everything happened on WebSocket connections. connId is the ID of the
+// connection in listen mode, or 0 for the connection of the client.
+type EventSink interface {
+	Connected(connId uint64, remoteAddr string)
+	Disconnected(connId uint64, code int, reason string)
+	Received(connId uint64, messageType int, payload []byte)
+	Sent(connId uint64, messageType int, payload []byte)
+	// Injected is a message written from the console to the client, or to the upstream server
+	// if toClient is false, of a connection in proxy mode.
+	Injected(connId uint64, toClient bool, messageType int, payload []byte)
+}
+
+func SetEventSink(s EventSink) {
+	loggerMu.Lock()
+	wsdogEvents = s
+	loggerMu.Unlock()
+}
+
+var wsdogEvents = EventSink(&HumanEventSink{})
+
+// HumanEventSink prints received messages on the console. Other events are already
+// reported by the Logger in a human-readable way, so they are ignored here.
+// Text messages in JSON are pretty-printed with jsonPalette if it's not nil. Binary Messages
+// are decoded by the first decoder which can decode them, or rendered in binaryFormat, which
+// is Base64 by default.
+type HumanEventSink struct {
+	jsonPalette  *JsonPalette
+	binaryFormat string
+	decoders     []PayloadCodec
+	// proxy prints messages sent too, as they are the ones from the upstream server in proxy mode
+	proxy bool
+}
+
+func (s *HumanEventSink) Connected(connId uint64, remoteAddr string) {}
+
+func (s *HumanEventSink) Disconnected(connId uint64, code int, reason string) {}
+
+func (s *HumanEventSink) Received(connId uint64, messageType int, payload []byte) {
+	if s.proxy {
+		s.printMessage(connPrefix(connId)+"client >", messageType, payload, "")
+	} else {
+		s.printMessage(connPrefix(connId)+"<", messageType, payload, "")
+	}
+}
+
+// printMessage prints a Text Message after the arrow, or a Binary Message after the arrow with
+// its last character doubled, like "<<". The note is printed after the message if it's not empty.
+func (s *HumanEventSink) printMessage(arrow string, messageType int, payload []byte, note string) {
+	switch messageType {
+	case websocket.TextMessage:
+		wsdogLogger.ReceiveMessagef("%s %s%s", arrow, s.formatText(payload), note)
+	case websocket.BinaryMessage:
+		arrow += arrow[len(arrow)-1:]
+		for _, decoder := range s.decoders {
+			decoded, err := decoder.Decode(payload)
+			if err == nil {
+				wsdogLogger.ReceiveMessagef("%s %s %s%s", arrow, decoder.Name(), s.formatText(decoded), note)
+				return
+			}
+			wsdogLogger.Debugf("%s", err)
+		}
+		wsdogLogger.ReceiveMessagef("%s %s%s", arrow, formatBinary(payload, s.binaryFormat), note)
+	}
+}
+
+// formatText pretty-prints the text if it's in JSON and jsonPalette is set, or returns it as is.
+func (s *HumanEventSink) formatText(text []byte) string {
+	if s.jsonPalette != nil {
+		if pretty, ok := prettyJson(text, s.jsonPalette); ok {
+			return pretty
+		}
+	}
+	return string(text)
+}
+
+func (s *HumanEventSink) Sent(connId uint64, messageType int, payload []byte) {
+	if s.proxy {
+		s.printMessage(connPrefix(connId)+"server <", messageType, payload, "")
+	}
+}
+
+// Injected prints the message like the ones forwarded in the same direction, marked as injected.
+func (s *HumanEventSink) Injected(connId uint64, toClient bool, messageType int, payload []byte) {
+	if toClient {
+		s.printMessage(connPrefix(connId)+"server <", messageType, payload, " (injected)")
+	} else {
+		s.printMessage(connPrefix(connId)+"client >", messageType, payload, " (injected)")
+	}
+}
+
+// JsonLinesEvent is a line written by JsonLinesEventSink.
+type JsonLinesEvent struct {
+	Time       string `json:"time"`
+	Event      string `json:"event"`
+	ConnId     uint64 `json:"conn,omitempty"`
+	Direction  string `json:"direction,omitempty"`
+	Opcode     string `json:"opcode,omitempty"`
+	Payload    string `json:"payload,omitempty"`
+	Encoding   string `json:"encoding,omitempty"`
+	Length     *int   `json:"length,omitempty"`
+	Code       int    `json:"code,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	RemoteAddr string `json:"remote,omitempty"`
+	Injected   bool   `json:"injected,omitempty"`
+}
+
+// JsonLinesEventSink writes every event as a JSON object in a line, so the output can be piped to
+// tools like jq. Payloads of binary frames, or any frame which is not valid UTF-8, are in Base64.
+type JsonLinesEventSink struct {
+	mu sync.Mutex
+}
+
+func opcodeName(messageType int) string {
+	switch messageType {
+	case websocket.TextMessage:
+		return "text"
+	case websocket.BinaryMessage:
+		return "binary"
+	case websocket.PingMessage:
+		return "ping"
+	case websocket.PongMessage:
+		return "pong"
+	case websocket.CloseMessage:
+		return "close"
+	}
+	return fmt.Sprintf("%d", messageType)
+}
+
+func (s *JsonLinesEventSink) write(event *JsonLinesEvent) {
+	event.Time = time.Now().Format(time.RFC3339Nano)
+	bs, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// write through color.Output so the lines do not mess up the console prompt in listen mode
+	if _, err := fmt.Fprintln(color.Output, string(bs)); err != nil {
+		panic(err)
+	}
+}
+
+func (s *JsonLinesEventSink) Connected(connId uint64, remoteAddr string) {
+	s.write(&JsonLinesEvent{Event: "connect", ConnId: connId, RemoteAddr: remoteAddr})
+}
+
+func (s *JsonLinesEventSink) Disconnected(connId uint64, code int, reason string) {
+	s.write(&JsonLinesEvent{Event: "disconnect", ConnId: connId, Code: code, Reason: reason})
+}
+
+func newFrameEvent(connId uint64, direction string, messageType int, payload []byte) *JsonLinesEvent {
+	length := len(payload)
+	event := JsonLinesEvent{Event: "frame", ConnId: connId, Direction: direction, Opcode: opcodeName(messageType), Length: &length}
+	if messageType == websocket.CloseMessage && len(payload) >= 2 {
+		event.Code = int(binary.BigEndian.Uint16(payload))
+		event.Reason = string(payload[2:])
+		payload = payload[2:]
+	}
+
+	if messageType == websocket.BinaryMessage || !utf8.Valid(payload) {
+		event.Payload = base64.StdEncoding.EncodeToString(payload)
+		event.Encoding = "base64"
+	} else {
+		event.Payload = string(payload)
+	}
+	return &event
+}
+
+// newInjectedFrameEvent returns the event of an injected message. Its direction is the one of the
+// messages forwarded to the same side, "in" for the upstream server or "out" for the client.
+func newInjectedFrameEvent(connId uint64, toClient bool, messageType int, payload []byte) *JsonLinesEvent {
+	direction := "in"
+	if toClient {
+		direction = "out"
+	}
+	event := newFrameEvent(connId, direction, messageType, payload)
+	event.Injected = true
+	return event
+}
+
+func (s *JsonLinesEventSink) Received(connId uint64, messageType int, payload []byte) {
+	s.write(newFrameEvent(connId, "in", messageType, payload))
+}
+
+func (s *JsonLinesEventSink) Sent(connId uint64, messageType int, payload []byte) {
+	s.write(newFrameEvent(connId, "out", messageType, payload))
+}
+
+func (s *JsonLinesEventSink) Injected(connId uint64, toClient bool, messageType int, payload []byte) {
+	s.write(newInjectedFrameEvent(connId, toClient, messageType, payload))
+}
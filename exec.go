@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// splitCommandLine splits a command line like `grep -i "hello world"` into its arguments. Arguments
+// can be quoted by single or double quotes, and a backslash escapes the next character out of single quotes.
+func splitCommandLine(commandLine string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range commandLine {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in command: \"%s\"", commandLine)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// execEnv returns the environment of the process of a connection, which has the metadata of the
+// connection in variables named like CGI ones, and each request header in HTTP_<NAME>.
+func execEnv(c *ServerConn, r *http.Request) []string {
+	env := os.Environ()
+	remoteHost, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteHost = r.RemoteAddr
+	}
+	env = append(env,
+		fmt.Sprintf("WSDOG_CONN_ID=%d", c.id),
+		"REMOTE_ADDR="+remoteHost,
+		"REMOTE_PORT="+remotePort,
+		"REQUEST_URI="+r.URL.RequestURI(),
+		"PATH_INFO="+r.URL.Path,
+		"QUERY_STRING="+r.URL.RawQuery,
+		"SERVER_PROTOCOL="+r.Proto,
+	)
+	if len(c.conn.Subprotocol()) > 0 {
+		env = append(env, "WEBSOCKET_PROTOCOL="+c.conn.Subprotocol())
+	}
+	for name, values := range r.Header {
+		env = append(env, "HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))+"="+strings.Join(values, ", "))
+	}
+	return env
+}
+
+// ExecProcess is the process started for a connection with --exec. Lines written to its stdout are
+// sent to the client as Text Messages, and lines written to its stderr are printed on the console.
+type ExecProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	conn   *ServerConn
+	exited chan struct{}
+	// exitState and exitErr are set when exited is closed
+	exitState *os.ProcessState
+	exitErr   error
+}
+
+func startExecProcess(command []string, c *ServerConn, r *http.Request) (*ExecProcess, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = execEnv(c, r)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &ExecProcess{cmd: cmd, stdin: stdin, conn: c, exited: make(chan struct{})}
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		p.forwardStdout(stdout)
+	}()
+	go func() {
+		defer readers.Done()
+		p.printStderr(stderr)
+	}()
+	go func() {
+		p.exitState, p.exitErr = cmd.Process.Wait()
+		// children left by the process may keep its stdout and stderr open, so they are only waited for a while
+		outputDone := make(chan struct{})
+		go func() {
+			readers.Wait()
+			close(outputDone)
+		}()
+		select {
+		case <-outputDone:
+		case <-time.After(defaultExecKillTimeout):
+			wsdogLogger.Debugf("output of process %d is still open after it exited", cmd.Process.Pid)
+		}
+		for _, pipe := range []io.Closer{stdin, stdout, stderr} {
+			_ = pipe.Close()
+		}
+		<-outputDone
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+func readLines(reader io.Reader, onLine func(line string)) {
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadString('\n')
+		if len(line) > 0 {
+			onLine(strings.TrimRight(line, "\r\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *ExecProcess) forwardStdout(stdout io.Reader) {
+	failed := false
+	readLines(stdout, func(line string) {
+		if failed {
+			return
+		}
+		if err := p.conn.writeMessage(websocket.TextMessage, []byte(line)); err != nil {
+			// keep reading so the process is not blocked on a full pipe until it's terminated
+			wsdogLogger.Errorf("write to client %d failed: %s", p.conn.id, err)
+			failed = true
+		}
+	})
+}
+
+func (p *ExecProcess) printStderr(stderr io.Reader) {
+	prefix := connPrefix(p.conn.id)
+	readLines(stderr, func(line string) {
+		wsdogLogger.Okf("%sstderr: %s", prefix, line)
+	})
+}
+
+// writeLine writes the payload of a Text Message to the stdin of the process as a line.
+func (p *ExecProcess) writeLine(payload []byte) error {
+	if _, err := p.stdin.Write(append(payload, '\n')); err != nil {
+		return fmt.Errorf("write to stdin of process %d failed: %s", p.cmd.Process.Pid, err)
+	}
+	return nil
+}
+
+// describeExit returns the close code and reason sent to the client when the process exited.
+func (p *ExecProcess) describeExit(closeCode int, errorCloseCode int) (int, string) {
+	if p.exitErr != nil {
+		return errorCloseCode, fmt.Sprintf("process failed: %s", p.exitErr)
+	} else if !p.exitState.Success() {
+		return errorCloseCode, fmt.Sprintf("process %s", p.exitState)
+	}
+	return closeCode, "process exited"
+}
+
+// terminate closes the stdin of the process and asks it to quit, then kills it if it's still
+// running after defaultExecKillTimeout. Children started by the process are not terminated.
+func (p *ExecProcess) terminate() {
+	select {
+	case <-p.exited:
+		return
+	default:
+	}
+
+	if err := p.stdin.Close(); err != nil {
+		wsdogLogger.Debugf("close stdin of process %d failed: %s", p.cmd.Process.Pid, err)
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		wsdogLogger.Debugf("terminate process %d failed: %s", p.cmd.Process.Pid, err)
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(defaultExecKillTimeout):
+		wsdogLogger.Errorf("process %d of client %d did not quit in %s, killing it", p.cmd.Process.Pid, p.conn.id, defaultExecKillTimeout)
+		if err := p.cmd.Process.Kill(); err != nil {
+			wsdogLogger.Debugf("kill process %d failed: %s", p.cmd.Process.Pid, err)
+		}
+		<-p.exited
+	}
+}
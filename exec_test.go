@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		commandLine string
+		want        []string
+		wantErr     bool
+	}{
+		{commandLine: "cat", want: []string{"cat"}},
+		{commandLine: "  grep  -i\terror  ", want: []string{"grep", "-i", "error"}},
+		{commandLine: `grep -i "hello world"`, want: []string{"grep", "-i", "hello world"}},
+		{commandLine: `echo 'it''s' "a 'b'" 'a "b"'`, want: []string{"echo", "its", "a 'b'", `a "b"`}},
+		{commandLine: `echo "" ''`, want: []string{"echo", "", ""}},
+		{commandLine: `echo hello\ world \"x\"`, want: []string{"echo", "hello world", `"x"`}},
+		{commandLine: `echo "a\"b" 'a\b'`, want: []string{"echo", `a"b`, `a\b`}},
+		{commandLine: `sh -c"echo hi"`, want: []string{"sh", "-cecho hi"}},
+		{commandLine: "", wantErr: true},
+		{commandLine: "   ", wantErr: true},
+		{commandLine: `echo "hello`, wantErr: true},
+		{commandLine: `echo 'hello`, wantErr: true},
+		{commandLine: `echo hello\`, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := splitCommandLine(test.commandLine)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("splitCommandLine(%q) = %q, want error", test.commandLine, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitCommandLine(%q) failed: %s", test.commandLine, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitCommandLine(%q) = %q, want %q", test.commandLine, got, test.want)
+		}
+	}
+}
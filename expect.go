@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"strings"
+)
+
+// Exit codes telling scripts why a run failed. Any other error, like an invalid option, exits with 1.
+const (
+	ExitOk                = 0
+	ExitError             = 1
+	ExitConnectFailed     = 2
+	ExitHandshakeRejected = 3
+	ExitTimeout           = 4
+	ExitAssertionFailed   = 5
+	ExitUnexpectedClose   = 6
+)
+
+// Expectation tracks whether a message matching the expectation given by --expect,
+// --expect-regex or --expect-json has been received.
+type Expectation struct {
+	matcher  *MessageMatcher
+	received int
+	met      bool
+}
+
+// NewExpectation returns nil when no expectation is given.
+func NewExpectation(cliOpts CommandLineOptions) (*Expectation, error) {
+	if len(cliOpts.Expect) == 0 && len(cliOpts.ExpectRegex) == 0 && len(cliOpts.ExpectJson) == 0 {
+		return nil, nil
+	}
+
+	var matcher MessageMatcher
+	if len(cliOpts.Expect) > 0 {
+		matcher.Exact = &cliOpts.Expect
+	}
+	matcher.Regex = cliOpts.ExpectRegex
+	if len(cliOpts.ExpectJson) > 0 {
+		toks := strings.SplitN(cliOpts.ExpectJson, "=", 2)
+		matcher.JsonPath = toks[0]
+		if len(toks) > 1 {
+			matcher.Value = &toks[1]
+		}
+	}
+	if err := matcher.compile(); err != nil {
+		return nil, fmt.Errorf("invalid expectation: %s", err)
+	}
+	return &Expectation{matcher: &matcher}, nil
+}
+
+// observe returns whether the expectation has been met after receiving the message.
+func (e *Expectation) observe(message *WebSocketMessage) bool {
+	e.received++
+	if !e.met {
+		if _, _, ok := e.matcher.match(message.payload); ok {
+			e.met = true
+			wsdogLogger.Okf("Expectation met: received %s", e.matcher)
+		}
+	}
+	return e.met
+}
+
+// failureExitCode tells an expectation which was never met because nothing was received
+// from one which was not met by the messages received.
+func (e *Expectation) failureExitCode() int {
+	wsdogLogger.Errorf("expectation failed: %s not received after %d message(s)", e.matcher, e.received)
+	if e.received == 0 {
+		return ExitTimeout
+	}
+	return ExitAssertionFailed
+}
+
+func isExpectedCloseCode(code int) bool {
+	return code == 0 || code == websocket.CloseNormalClosure || code == websocket.CloseGoingAway
+}
+
+// connectError is returned when dialing the server failed.
+type connectError struct {
+	url      string
+	err      error
+	rejected bool
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("connect to \"%s\" failed with error: \"%s\"", e.url, e.err)
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+func connectExitCode(err error) int {
+	var connErr *connectError
+	if errors.As(err, &connErr) && connErr.rejected {
+		return ExitHandshakeRejected
+	}
+	return ExitConnectFailed
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// MessageWireStats tells how a received data message looked like on the wire.
+type MessageWireStats struct {
+	compressed bool
+	// wireSize is the size of the payload of all the frames of the message, before decompression
+	wireSize int
+}
+
+type sniffState int
+
+const (
+	// bytes read are not WebSocket frames yet, and the sniffer waits for beginFrames
+	sniffPassthrough sniffState = iota
+	// bytes read are the HTTP response of the handshake, then WebSocket frames
+	sniffHttpResponse
+	sniffFrames
+)
+
+var httpHeaderEnd = []byte("\r\n\r\n")
+
+// frameSniffer is a net.Conn which parses the headers of the WebSocket frames read through it,
+// because the websocket library does not tell whether a received message was compressed and how
+// large it was on the wire. It must see the frames in plain text, so it can't be used under TLS.
+type frameSniffer struct {
+	net.Conn
+
+	mu             sync.Mutex
+	state          sniffState
+	headerEndMatch int
+	header         []byte
+	payloadLeft    uint64
+	current        *MessageWireStats
+	messages       []MessageWireStats
+}
+
+func (s *frameSniffer) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	if n > 0 {
+		s.mu.Lock()
+		s.feed(p[:n])
+		s.mu.Unlock()
+	}
+	return n, err
+}
+
+// beginFrames tells the sniffer that every byte read from now on is a WebSocket frame.
+func (s *frameSniffer) beginFrames() {
+	s.mu.Lock()
+	s.state = sniffFrames
+	s.mu.Unlock()
+}
+
+// popMessage returns the stats of the earliest data message which is not popped yet.
+func (s *frameSniffer) popMessage() (MessageWireStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		return MessageWireStats{}, false
+	}
+	stats := s.messages[0]
+	s.messages = s.messages[1:]
+	return stats, true
+}
+
+func (s *frameSniffer) feed(data []byte) {
+	for len(data) > 0 {
+		switch s.state {
+		case sniffPassthrough:
+			return
+		case sniffHttpResponse:
+			b := data[0]
+			data = data[1:]
+			if b == httpHeaderEnd[s.headerEndMatch] {
+				s.headerEndMatch++
+			} else if b == httpHeaderEnd[0] {
+				s.headerEndMatch = 1
+			} else {
+				s.headerEndMatch = 0
+			}
+			if s.headerEndMatch == len(httpHeaderEnd) {
+				s.state = sniffFrames
+			}
+		case sniffFrames:
+			if s.payloadLeft > 0 {
+				skip := uint64(len(data))
+				if skip > s.payloadLeft {
+					skip = s.payloadLeft
+				}
+				s.payloadLeft -= skip
+				data = data[skip:]
+				continue
+			}
+			s.header = append(s.header, data[0])
+			data = data[1:]
+			s.parseFrameHeader()
+		}
+	}
+}
+
+// parseFrameHeader updates the stats when the frame header is complete. See RFC 6455 section 5.2.
+func (s *frameSniffer) parseFrameHeader() {
+	if len(s.header) < 2 {
+		return
+	}
+	headerSize := 2
+	switch s.header[1] & 0x7f {
+	case 126:
+		headerSize += 2
+	case 127:
+		headerSize += 8
+	}
+	if s.header[1]&0x80 != 0 {
+		headerSize += 4
+	}
+	if len(s.header) < headerSize {
+		return
+	}
+
+	fin := s.header[0]&0x80 != 0
+	rsv1 := s.header[0]&0x40 != 0
+	opcode := s.header[0] & 0x0f
+	var payloadLength uint64
+	switch s.header[1] & 0x7f {
+	case 126:
+		payloadLength = uint64(binary.BigEndian.Uint16(s.header[2:4]))
+	case 127:
+		payloadLength = binary.BigEndian.Uint64(s.header[2:10])
+	default:
+		payloadLength = uint64(s.header[1] & 0x7f)
+	}
+	s.header = s.header[:0]
+	s.payloadLeft = payloadLength
+
+	// control frames can be interleaved with the frames of a data message
+	if opcode >= 0x8 {
+		return
+	}
+	if opcode != 0x0 || s.current == nil {
+		s.current = &MessageWireStats{compressed: rsv1}
+	}
+	s.current.wireSize += int(payloadLength)
+	if fin {
+		s.messages = append(s.messages, *s.current)
+		s.current = nil
+	}
+}
+
+// frameSniffingListener wraps every accepted connection with a frameSniffer. The sniffer passes
+// through HTTP requests until beginFrames is called after the connection is upgraded.
+type frameSniffingListener struct {
+	net.Listener
+}
+
+func (l frameSniffingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &frameSniffer{Conn: conn, state: sniffPassthrough}, nil
+}
+
+// canSniffFrames returns whether the frames to the URL can be seen by a frameSniffer on the
+// connection dialed, which is not true for wss:// or when the connection is through a proxy.
+func canSniffFrames(u *url.URL) bool {
+	if u.Scheme != "ws" {
+		return false
+	}
+	proxyUrl, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "http", Host: u.Host}})
+	return err == nil && proxyUrl == nil
+}
+
+// dialFrameSniffer dials like the websocket library does without a proxy, and sniffs the frames
+// after the HTTP response of the handshake.
+func dialFrameSniffer(network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: defaultHandshakeTimeout}).Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &frameSniffer{Conn: conn, state: sniffHttpResponse}, nil
+}
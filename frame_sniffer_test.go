@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func encodeFrames(mask bool, frames ...RawFrame) []byte {
+	var bs []byte
+	for _, frame := range frames {
+		bs = append(bs, frame.encode(mask)...)
+	}
+	return bs
+}
+
+func TestFrameSnifferFeed(t *testing.T) {
+	short := bytes.Repeat([]byte("a"), 10)
+	medium := bytes.Repeat([]byte("b"), 300)
+	long := bytes.Repeat([]byte("c"), 70000)
+	tests := []struct {
+		name  string
+		state sniffState
+		data  []byte
+		want  []MessageWireStats
+	}{
+		{
+			name:  "single frames",
+			state: sniffFrames,
+			data: encodeFrames(false,
+				RawFrame{fin: true, opcode: 0x1, payload: short},
+				RawFrame{fin: true, rsv: 0x40, opcode: 0x2, payload: medium}),
+			want: []MessageWireStats{{false, 10}, {true, 300}},
+		},
+		{
+			name:  "64-bit length",
+			state: sniffFrames,
+			data:  encodeFrames(false, RawFrame{fin: true, rsv: 0x40, opcode: 0x1, payload: long}),
+			want:  []MessageWireStats{{true, 70000}},
+		},
+		{
+			name:  "masked frames",
+			state: sniffFrames,
+			data: encodeFrames(true,
+				RawFrame{fin: true, opcode: 0x1, payload: medium},
+				RawFrame{fin: true, opcode: 0x1, payload: short}),
+			want: []MessageWireStats{{false, 300}, {false, 10}},
+		},
+		{
+			name:  "fragmented message with an interleaved ping",
+			state: sniffFrames,
+			data: encodeFrames(false,
+				RawFrame{fin: false, rsv: 0x40, opcode: 0x1, payload: short},
+				RawFrame{fin: true, opcode: 0x9, payload: short},
+				RawFrame{fin: false, opcode: 0x0, payload: medium},
+				RawFrame{fin: true, opcode: 0x0, payload: short}),
+			want: []MessageWireStats{{true, 320}},
+		},
+		{
+			name:  "control frames only",
+			state: sniffFrames,
+			data: encodeFrames(false,
+				RawFrame{fin: true, opcode: 0x9, payload: short},
+				RawFrame{fin: true, opcode: 0x8, payload: []byte{0x03, 0xe8}}),
+		},
+		{
+			name:  "http response before frames",
+			state: sniffHttpResponse,
+			data: append([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"),
+				encodeFrames(false, RawFrame{fin: true, opcode: 0x1, payload: short})...),
+			want: []MessageWireStats{{false, 10}},
+		},
+		{
+			name:  "passthrough",
+			state: sniffPassthrough,
+			data:  encodeFrames(false, RawFrame{fin: true, opcode: 0x1, payload: short}),
+		},
+	}
+	for _, test := range tests {
+		// the frames are parsed the same whether they are read at once or a few bytes at a time
+		for _, chunkSize := range []int{len(test.data), 7, 1} {
+			s := frameSniffer{state: test.state}
+			for data := test.data; len(data) > 0; {
+				n := chunkSize
+				if n > len(data) {
+					n = len(data)
+				}
+				s.feed(data[:n])
+				data = data[n:]
+			}
+			var got []MessageWireStats
+			for {
+				stats, ok := s.popMessage()
+				if !ok {
+					break
+				}
+				got = append(got, stats)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s, read %d bytes at a time: got %+v, want %+v", test.name, chunkSize, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// printHeaders prints the headers sorted by their names, each one in a line with the prefix.
+func printHeaders(prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			wsdogLogger.Okf("%s%s: %s", prefix, name, value)
+		}
+	}
+}
+
+func printHandshakeRequest(prefix string, req *http.Request) {
+	wsdogLogger.Okf("%s%s %s %s", prefix, req.Method, req.URL.RequestURI(), req.Proto)
+	wsdogLogger.Okf("%sHost: %s", prefix, req.Host)
+	printHeaders(prefix, req.Header)
+}
+
+func printNegotiated(subprotocol string, extensions []string) {
+	if len(subprotocol) == 0 {
+		subprotocol = "(none)"
+	}
+	extension := "(none)"
+	if len(extensions) > 0 {
+		extension = strings.Join(extensions, ", ")
+	}
+	wsdogLogger.Okf("Subprotocol: %s", subprotocol)
+	wsdogLogger.Okf("Extensions: %s", extension)
+}
+
+// printHandshake prints the upgrade request sent by the client and the response from the server.
+// The body of the response is printed too if the server rejected the upgrade.
+func printHandshake(resp *http.Response) {
+	if resp.Request != nil {
+		printHandshakeRequest("> ", resp.Request)
+	}
+	wsdogLogger.Okf("< %s %s", resp.Proto, resp.Status)
+	printHeaders("< ", resp.Header)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		printNegotiated(resp.Header.Get(subprotocolHeader), resp.Header.Values(extensionsHeader))
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		wsdogLogger.Debugf("read response body failed: %s", err)
+	}
+	if len(body) > 0 {
+		wsdogLogger.Okf("<")
+		for _, line := range strings.Split(strings.TrimRight(string(body), "\r\n"), "\n") {
+			wsdogLogger.Okf("< %s", strings.TrimRight(line, "\r"))
+		}
+	}
+}
+
+// printUpgradeResponse prints the response to an accepted upgrade request like printHandshake.
+func printUpgradeResponse(resp *http.Response) {
+	wsdogLogger.Okf("> %s %s", resp.Proto, resp.Status)
+	printHeaders("> ", resp.Header)
+	printNegotiated(resp.Header.Get(subprotocolHeader), resp.Header.Values(extensionsHeader))
+}
+
+// handshakeRecorder records the response to an upgrade request. The status of a rejected upgrade
+// is recorded by WriteHeader. The Upgrader writes the response to an accepted upgrade directly to
+// the hijacked connection, so it's captured from the connection.
+type handshakeRecorder struct {
+	http.ResponseWriter
+	status   int
+	captured *responseCapturingConn
+}
+
+func (r *handshakeRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// printResponse prints the status and the headers of the response to a rejected upgrade request.
+func (r *handshakeRecorder) printResponse(req *http.Request) {
+	wsdogLogger.Okf("> %s %d %s", req.Proto, r.status, http.StatusText(r.status))
+	printHeaders("> ", r.Header())
+}
+
+func (r *handshakeRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.captured = &responseCapturingConn{Conn: conn}
+	return r.captured, rw, nil
+}
+
+// upgradeResponse parses the response captured after the upgrade request was accepted.
+func (r *handshakeRecorder) upgradeResponse(req *http.Request) (*http.Response, error) {
+	if r.captured == nil || !r.captured.complete {
+		return nil, errors.New("no upgrade response captured")
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(r.captured.response.Bytes())), req)
+}
+
+// responseCapturingConn keeps what's written to the connection up to the end of the headers of
+// the HTTP response, which is the upgrade response written by the Upgrader.
+type responseCapturingConn struct {
+	net.Conn
+	// response and complete are only written by the Upgrader before it returns the connection
+	response bytes.Buffer
+	complete bool
+}
+
+func (c *responseCapturingConn) Write(p []byte) (int, error) {
+	if !c.complete {
+		c.response.Write(p)
+		if end := bytes.Index(c.response.Bytes(), []byte("\r\n\r\n")); end >= 0 {
+			c.response.Truncate(end + 4)
+			c.complete = true
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// frameSnifferOf returns the frameSniffer under the connection if its frames are sniffed.
+func frameSnifferOf(conn *websocket.Conn) (*frameSniffer, bool) {
+	netConn := conn.UnderlyingConn()
+	if captured, ok := netConn.(*responseCapturingConn); ok {
+		netConn = captured.Conn
+	}
+	sniffer, ok := netConn.(*frameSniffer)
+	return sniffer, ok
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestResponseCapturingConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = ioutil.ReadAll(client)
+	}()
+
+	captured := &responseCapturingConn{Conn: server}
+	writes := []string{
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n",
+		"Connection: Upgrade\r\nSec-WebSocket-Protocol: chat\r\n\r\n\x81\x02hi",
+		"\x81\x02hi",
+	}
+	for _, w := range writes {
+		if _, err := captured.Write([]byte(w)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Close()
+
+	recorder := handshakeRecorder{captured: captured}
+	resp, err := recorder.upgradeResponse(&http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got := resp.Header.Get(subprotocolHeader); got != "chat" {
+		t.Errorf("subprotocol = %q, want %q", got, "chat")
+	}
+	if got := captured.response.String(); got[len(got)-4:] != "\r\n\r\n" {
+		t.Errorf("captured response does not end with the headers: %q", got)
+	}
+}
+
+func TestUpgradeResponseNotCaptured(t *testing.T) {
+	captured := &responseCapturingConn{}
+	captured.response.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	recorder := handshakeRecorder{captured: captured}
+	if _, err := recorder.upgradeResponse(&http.Request{Method: http.MethodGet}); err == nil {
+		t.Error("upgradeResponse() succeeded with incomplete headers")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is either a key of an object or an index of an array.
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// JsonPath is a small subset of JSONPath which only supports the root "$" followed by
+// child keys (".key" or "['key']") and array indexes ("[0]"), like "$.data.items[0].id".
+type JsonPath struct {
+	expr  string
+	steps []jsonPathStep
+}
+
+func CompileJsonPath(expr string) (*JsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath \"%s\" must start with \"$\"", expr)
+	}
+
+	path := JsonPath{expr: expr}
+	rest := expr[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in JSONPath \"%s\"", expr)
+			}
+			path.steps = append(path.steps, jsonPathStep{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed \"[\" in JSONPath \"%s\"", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path.steps = append(path.steps, jsonPathStep{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index \"%s\" in JSONPath \"%s\"", inner, expr)
+			}
+			path.steps = append(path.steps, jsonPathStep{index: index, isIndex: true})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in JSONPath \"%s\"", rest[0], expr)
+		}
+	}
+	return &path, nil
+}
+
+// Lookup returns the value at the path in a JSON document decoded by encoding/json.
+func (p *JsonPath) Lookup(doc interface{}) (interface{}, bool) {
+	node := doc
+	for _, step := range p.steps {
+		if step.isIndex {
+			arr, ok := node.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			index := step.index
+			if index < 0 {
+				index += len(arr)
+			}
+			if index < 0 || index >= len(arr) {
+				return nil, false
+			}
+			node = arr[index]
+		} else {
+			obj, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if node, ok = obj[step.key]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return node, true
+}
+
+// LookupString returns the value at the path as a string. Strings are returned as is
+// and other values are returned in their JSON form.
+func (p *JsonPath) LookupString(doc interface{}) (string, bool) {
+	node, ok := p.Lookup(doc)
+	if !ok {
+		return "", false
+	}
+	if s, ok := node.(string); ok {
+		return s, true
+	}
+	bs, err := json.Marshal(node)
+	if err != nil {
+		return "", false
+	}
+	return string(bs), true
+}
+
+func (p *JsonPath) String() string {
+	return p.expr
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompileJsonPath(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"$", false},
+		{"$.type", false},
+		{"$.data.items[0].id", false},
+		{"$['a key'][\"b\"]", false},
+		{"$.items[-1]", false},
+		{"type", true},
+		{"$..type", true},
+		{"$.", true},
+		{"$.items[0", true},
+		{"$.items[x]", true},
+		{"$type", true},
+	}
+	for _, test := range tests {
+		_, err := CompileJsonPath(test.expr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("CompileJsonPath(%q) error = %v, want error %v", test.expr, err, test.wantErr)
+		}
+	}
+}
+
+func TestJsonPathLookupString(t *testing.T) {
+	doc := `{"type":"ack","data":{"items":[{"id":1},{"id":"two"}],"ok":true,"none":null},"a key":"spaced"}`
+	tests := []struct {
+		expr   string
+		want   string
+		wantOk bool
+	}{
+		{"$.type", "ack", true},
+		{"$.data.items[0].id", "1", true},
+		{"$.data.items[1].id", "two", true},
+		{"$.data.items[-1].id", "two", true},
+		{"$['a key']", "spaced", true},
+		{"$.data.ok", "true", true},
+		{"$.data.none", "null", true},
+		{"$.data.items[0]", `{"id":1}`, true},
+		{"$.data.items[2]", "", false},
+		{"$.data.items[-3]", "", false},
+		{"$.missing", "", false},
+		{"$.type.nested", "", false},
+		{"$.data[0]", "", false},
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(doc), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		path, err := CompileJsonPath(test.expr)
+		if err != nil {
+			t.Fatalf("CompileJsonPath(%q) failed: %s", test.expr, err)
+		}
+		got, ok := path.LookupString(parsed)
+		if ok != test.wantOk || got != test.want {
+			t.Errorf("LookupString(%q) = %q, %v, want %q, %v", test.expr, got, ok, test.want, test.wantOk)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keepalivePingPrefix starts the payload of keepalive pings, followed by the time the ping was
+// sent in nanoseconds, so the round-trip time can be measured from the pong echoing it.
+const keepalivePingPrefix = "wsdog-keepalive:"
+
+func newKeepalivePayload() []byte {
+	return []byte(keepalivePingPrefix + strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// keepaliveRoundTripTime returns the round-trip time if the payload of a pong echoes a keepalive ping.
+func keepaliveRoundTripTime(payload string) (time.Duration, bool) {
+	if !strings.HasPrefix(payload, keepalivePingPrefix) {
+		return 0, false
+	}
+	sentAt, err := strconv.ParseInt(strings.TrimPrefix(payload, keepalivePingPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, sentAt)), true
+}
+
+// Keepalive pings the peer every interval, and considers the connection dead if no pong is
+// received within pongTimeout after a ping is due.
+type Keepalive struct {
+	interval    time.Duration
+	pongTimeout time.Duration
+}
+
+// newKeepalive returns nil if interval is not positive. pongTimeout is defaultReadWaitDuration if
+// it's not positive.
+func newKeepalive(interval time.Duration, pongTimeout time.Duration) *Keepalive {
+	if interval <= 0 {
+		return nil
+	}
+	if pongTimeout <= 0 {
+		pongTimeout = defaultReadWaitDuration
+	}
+	return &Keepalive{interval: interval, pongTimeout: pongTimeout}
+}
+
+// extendReadDeadline makes reading from the connection time out if no pong arrives before the
+// next ping is due and answered. Like other read methods of the connection, it must be called
+// before reading starts or from the pong handler.
+func (k *Keepalive) extendReadDeadline(conn *websocket.Conn) error {
+	return conn.SetReadDeadline(time.Now().Add(k.interval + k.pongTimeout))
+}
+
+// start pings the peer every interval until done is closed or the connection is broken. Pongs are
+// checked on the read side by SetupReadFromConn.
+func (k *Keepalive) start(conn *websocket.Conn, connId uint64, done chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(k.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			payload := newKeepalivePayload()
+			if err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(defaultWriteWaitDuration)); err != nil {
+				wsdogLogger.Debugf("send keepalive ping failed: %s", err)
+				return
+			}
+			wsdogEvents.Sent(connId, websocket.PingMessage, payload)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewKeepalive(t *testing.T) {
+	tests := []struct {
+		interval    time.Duration
+		pongTimeout time.Duration
+		want        *Keepalive
+	}{
+		{0, time.Second, nil},
+		{-time.Second, time.Second, nil},
+		{10 * time.Second, 0, &Keepalive{10 * time.Second, defaultReadWaitDuration}},
+		{10 * time.Second, -time.Second, &Keepalive{10 * time.Second, defaultReadWaitDuration}},
+		{10 * time.Second, 2 * time.Second, &Keepalive{10 * time.Second, 2 * time.Second}},
+	}
+	for _, test := range tests {
+		got := newKeepalive(test.interval, test.pongTimeout)
+		if (got == nil) != (test.want == nil) || got != nil && *got != *test.want {
+			t.Errorf("newKeepalive(%s, %s) = %+v, want %+v", test.interval, test.pongTimeout, got, test.want)
+		}
+	}
+}
+
+func TestKeepaliveRoundTripTime(t *testing.T) {
+	sentAt := strconv.FormatInt(time.Now().Add(-time.Second).UnixNano(), 10)
+	tests := []struct {
+		payload string
+		ok      bool
+	}{
+		{keepalivePingPrefix + sentAt, true},
+		{string(newKeepalivePayload()), true},
+		{"", false},
+		{"hello", false},
+		{keepalivePingPrefix, false},
+		{keepalivePingPrefix + "soon", false},
+	}
+	for _, test := range tests {
+		rtt, ok := keepaliveRoundTripTime(test.payload)
+		if ok != test.ok {
+			t.Errorf("keepaliveRoundTripTime(%q) = %s, %v, want %v", test.payload, rtt, ok, test.ok)
+		}
+	}
+	if rtt, _ := keepaliveRoundTripTime(keepalivePingPrefix + sentAt); rtt < time.Second || rtt > time.Minute {
+		t.Errorf("round-trip time of a ping sent a second ago is %s", rtt)
+	}
+}
+
+// dialKeepaliveTestServer returns a connection to a server which replies pings with pongs only if
+// answerPings is true.
+func dialKeepaliveTestServer(t *testing.T, answerPings bool) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if answerPings {
+			// pings are replied by the default ping handler while reading
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+		<-stop
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		server.Close()
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKeepaliveDeadline(t *testing.T) {
+	tests := []struct {
+		name        string
+		answerPings bool
+		wantDead    bool
+	}{
+		{"peer answering pings", true, false},
+		{"peer not answering pings", false, true},
+	}
+	for _, test := range tests {
+		conn := dialKeepaliveTestServer(t, test.answerPings)
+		closed := make(chan string, 1)
+		output, done := SetupReadFromConn(conn, 0, false, newKeepalive(50*time.Millisecond, 50*time.Millisecond), func(code int, text string) {
+			closed <- text
+		})
+
+		// the connection is dead if no pong arrives within interval + pongTimeout
+		select {
+		case reason := <-closed:
+			if !test.wantDead {
+				t.Errorf("%s: connection is dead: %s", test.name, reason)
+			} else if reason != "no pong received in time" {
+				t.Errorf("%s: connection is dead for %q", test.name, reason)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if test.wantDead {
+				t.Errorf("%s: connection is still alive", test.name)
+			}
+		}
+		close(done)
+		conn.Close()
+		for range output {
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/fatih/color"
+	"io"
 	"os"
 	"sync"
 )
@@ -40,6 +41,15 @@ var (
 		receiveColor: color.New(color.FgWhite),
 		sendColor:    color.New(color.FgWhite),
 	}
+	// stderrLogger keeps stdout clean for machine-readable output
+	stderrLogger = &DefaultLogger{
+		debugColor:   color.New(color.FgWhite),
+		errorColor:   color.New(color.FgWhite),
+		okColor:      color.New(color.FgWhite),
+		receiveColor: color.New(color.FgWhite),
+		sendColor:    color.New(color.FgWhite),
+		output:       os.Stderr,
+	}
 	defaultLogger = &DefaultLogger{
 		debugColor:   color.New(color.FgWhite),
 		errorColor:   color.New(color.FgYellow),
@@ -59,6 +69,15 @@ type DefaultLogger struct {
 	receiveColor *color.Color
 	sendColor    *color.Color
 	debug        bool
+	output       io.Writer
+}
+
+// writer returns the output of the logger, which is color.Output by default.
+func (l *DefaultLogger) writer() io.Writer {
+	if l.output != nil {
+		return l.output
+	}
+	return color.Output
 }
 
 func (l *DefaultLogger) EnableDebug() {
@@ -67,51 +86,51 @@ func (l *DefaultLogger) EnableDebug() {
 
 func (l *DefaultLogger) Debug(v ...interface{}) {
 	if l.debug {
-		printConsoleln(l.debugColor, fmt.Sprintf("DEBUG: %s", v...))
+		printConsoleln(l.writer(), l.debugColor, fmt.Sprintf("DEBUG: %s", v...))
 	}
 }
 
 func (l *DefaultLogger) Debugf(format string, v ...interface{}) {
 	if l.debug {
-		printConsoleln(l.debugColor, fmt.Sprintf("DEBUG: %s", fmt.Sprintf(format, v...)))
+		printConsoleln(l.writer(), l.debugColor, fmt.Sprintf("DEBUG: %s", fmt.Sprintf(format, v...)))
 	}
 }
 
 func (l *DefaultLogger) ReceiveMessage(v ...interface{}) {
-	printConsoleln(l.receiveColor, v...)
+	printConsoleln(l.writer(), l.receiveColor, v...)
 }
 
 func (l *DefaultLogger) ReceiveMessagef(format string, v ...interface{}) {
-	printConsolelnf(l.receiveColor, format, v...)
+	printConsolelnf(l.writer(), l.receiveColor, format, v...)
 }
 
 func (l *DefaultLogger) Ok(v ...interface{}) {
-	printConsoleln(l.okColor, v...)
+	printConsoleln(l.writer(), l.okColor, v...)
 }
 
 func (l *DefaultLogger) Okf(format string, v ...interface{}) {
-	printConsolelnf(l.okColor, format, v...)
+	printConsolelnf(l.writer(), l.okColor, format, v...)
 }
 
 func (l *DefaultLogger) SendMessage(v ...interface{}) {
-	printConsole(l.sendColor, v...)
+	printConsole(l.writer(), l.sendColor, v...)
 }
 
 func (l *DefaultLogger) Error(v ...interface{}) {
-	printConsoleln(l.errorColor, v...)
+	printConsoleln(l.writer(), l.errorColor, v...)
 }
 
 func (l *DefaultLogger) Errorf(format string, v ...interface{}) {
-	printConsolelnf(l.errorColor, format, v...)
+	printConsolelnf(l.writer(), l.errorColor, format, v...)
 }
 
 func (l *DefaultLogger) Fatal(v ...interface{}) {
-	printConsoleln(l.errorColor, v...)
+	printConsoleln(l.writer(), l.errorColor, v...)
 	os.Exit(1)
 }
 
 func (l *DefaultLogger) Fatalf(format string, v ...interface{}) {
-	printConsolelnf(l.errorColor, format, v...)
+	printConsolelnf(l.writer(), l.errorColor, format, v...)
 	os.Exit(1)
 }
 
@@ -119,20 +138,20 @@ func trailingNewLine(msg string) string {
 	return fmt.Sprintf("%s\n", msg)
 }
 
-func printConsole(c *color.Color, v ...interface{}) {
-	if _, err := c.Print(v...); err != nil {
+func printConsole(w io.Writer, c *color.Color, v ...interface{}) {
+	if _, err := c.Fprint(w, v...); err != nil {
 		panic(err)
 	}
 }
 
-func printConsoleln(c *color.Color, v ...interface{}) {
-	if _, err := c.Println(v...); err != nil {
+func printConsoleln(w io.Writer, c *color.Color, v ...interface{}) {
+	if _, err := c.Fprintln(w, v...); err != nil {
 		panic(err)
 	}
 }
 
-func printConsolelnf(c *color.Color, format string, v ...interface{}) {
-	if _, err := c.Printf(trailingNewLine(fmt.Sprintf(format, v...))); err != nil {
+func printConsolelnf(w io.Writer, c *color.Color, format string, v ...interface{}) {
+	if _, err := c.Fprintf(w, trailingNewLine(fmt.Sprintf(format, v...))); err != nil {
 		panic(err)
 	}
 }
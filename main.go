@@ -1,49 +1,101 @@
 package main
 
 import (
+	"compress/flate"
 	"github.com/jessevdk/go-flags"
 	"os"
+	"time"
 )
 
 type ApplicationOptions struct {
-	ListenPort   uint16 `short:"l" long:"listen" description:"listen on port"`
-	ConnectUrl   string `short:"c" long:"connect" description:"connect to a WebSocket server"`
-	EnableDebug  bool   `long:"debug" description:"enable debug log"`
-	NoColor      bool   `long:"no-color" description:"Run without color"`
-	ShowPingPong bool   `short:"P" long:"show-ping-pong" description:"print a notification when a ping or pong is received"`
-	Subprotocol  string `short:"s" long:"subprotocol" description:"optional subprotocol (default: )"`
+	ListenPort        uint16        `short:"l" long:"listen" description:"listen on port"`
+	ConnectUrl        string        `short:"c" long:"connect" description:"connect to a WebSocket server"`
+	EnableDebug       bool          `long:"debug" description:"enable debug log"`
+	NoColor           bool          `long:"no-color" description:"Run without color"`
+	ShowPingPong      bool          `short:"P" long:"show-ping-pong" description:"print a notification when a ping or pong is received"`
+	Subprotocol       []string      `short:"s" long:"subprotocol" description:"subprotocol to request as a client or to accept as a server. Repeat or separate by commas to give several in preference order"`
+	StrictSubprotocol bool          `long:"strict-subprotocol" description:"as a client, fail when the server chooses no subprotocol. As a server, reject clients requesting none of the subprotocols with 400"`
+	PingInterval      time.Duration `long:"ping-interval" description:"send a ping every given duration to keep the connection alive, 0 means never"`
+	PongTimeout       time.Duration `long:"pong-timeout" description:"consider the connection dead if no pong is received in given duration after a ping (default: 5s)"`
+	VerboseHandshake  bool          `long:"verbose-handshake" description:"print the HTTP upgrade request and response of each connection"`
+	Compression       bool          `long:"compression" description:"negotiate permessage-deflate and report whether each received message was compressed"`
+	CompressionLevel  int           `long:"compression-level" default:"1" description:"level to compress sent messages with --compression, from -2 (Huffman only) to 9 (best compression)"`
+	Record            string        `long:"record" description:"record every frame with its timing to the given JSON Lines file"`
+	Format            string        `long:"format" default:"raw" choice:"raw" choice:"json" description:"print received Text Messages as is, or pretty-print the ones in JSON"`
+	Output            string        `long:"output" default:"text" choice:"text" choice:"jsonl" description:"print events in human-readable text or one JSON object per line"`
+	ProtoDescriptor   string        `long:"proto-descriptor" description:"decode received Binary Messages as protobuf with the FileDescriptorSet in the given file"`
+	ProtoType         string        `long:"proto-type" description:"full name of the protobuf message type in --proto-descriptor, like my.package.Event"`
+	Decode            string        `long:"decode" default:"none" choice:"none" choice:"auto" choice:"msgpack" choice:"cbor" description:"print received Binary Messages in MessagePack or CBOR as JSON. auto tries both on maps and arrays"`
+	BinaryFormat      string        `long:"binary-format" default:"base64" choice:"base64" choice:"hex" choice:"hexdump" choice:"utf8-lossy" description:"how to print received Binary Messages"`
 }
 
 type ListenOnPortOptions struct {
-	Echo       bool   `long:"echo" description:"write received message back to client (default: false)"`
-	ListenHost string `long:"listen-host" default:"0.0.0.0" description:"host to listen on"`
+	Echo               bool     `long:"echo" description:"write received message back to client (default: false)"`
+	Broadcast          bool     `long:"broadcast" description:"relay every received message to all the other clients in the same room, like a chat hub"`
+	RoomBy             string   `long:"room-by" default:"none" choice:"none" choice:"path" choice:"query" description:"group clients of --broadcast and chat routes into rooms by URL path, or by the room query parameter like ?room=lobby"`
+	ListenHost         string   `long:"listen-host" default:"0.0.0.0" description:"host to listen on"`
+	ListenCert         string   `long:"listen-cert" description:"serve wss:// with the certificate in PEM or PKCS#12 format"`
+	ListenKey          string   `long:"listen-key" description:"key of the certificate provided by --listen-cert. Can be omitted if the key is bundled in the certificate file"`
+	ListenPassphrase   string   `long:"listen-passphrase" description:"passphrase of the key provided by --listen-key. If you don't provide a value, it will be prompted for when needed"`
+	Rules              string   `long:"rules" description:"reply to received messages and push messages according to the rules in a YAML or JSON file"`
+	SelfSignedHosts    []string `long:"self-signed" description:"serve wss:// with a self-signed certificate generated for the given host name or IP. Repeat to add multiple hosts"`
+	Exec               string   `long:"exec" description:"start the given command for each client. Text Messages are written to its stdin as lines, and lines from its stdout are sent back as Text Messages"`
+	ExecCloseCode      int      `long:"exec-close-code" default:"1000" description:"close code sent to the client when the process of --exec exits successfully"`
+	ExecErrorCloseCode int      `long:"exec-error-close-code" default:"1011" description:"close code sent to the client when the process of --exec fails"`
+	Proxy              string   `long:"proxy" description:"relay each connection to the given upstream WebSocket URL and print the frames in both directions. The connect options apply to the upstream connections"`
+	Break              string   `long:"break" description:"in proxy mode, hold the Text and Binary Messages matching the given regex until they are forwarded, edited or dropped from the console"`
+	BreakOn            string   `long:"break-on" default:"both" choice:"both" choice:"client" choice:"server" description:"hold only the messages from the client or from the upstream server with --break"`
+	Routes             []string `long:"route" description:"serve the path with a behaviour: echo, print, chat, feed:<file>, rules:<file>, exec:<command> or reject[:status]. Repeat to declare multiple routes <path>=<behaviour>. Other paths get 404"`
+	MetricsPath        string   `long:"metrics-path" description:"serve connection and traffic stats on the given HTTP path, like /metrics, in Prometheus text format, or in JSON with ?format=json"`
 }
 
 type ConnectOptions struct {
-	Origin         string            `short:"o" long:"origin" description:"optional origin"`
-	ExecuteCommand string            `short:"x" long:"execute" description:"execute command after connecting"`
-	Wait           int64             `short:"w" long:"wait" default:"2" description:" wait given seconds after executing command"`
-	Host           string            `long:"host" description:"optional host"`
-	NoTlsCheck     bool              `short:"n" long:"no-check" description:"Do not check for unauthorized certificates"`
-	Headers        map[string]string `short:"H" long:"header" description:"Set an HTTP header <header:value>. Repeat to set multiple like -H header1:value1 -H header2:value2."`
-	Auth           string            `long:"auth" description:"Add basic HTTP authentication header <username:password>."`
-	//Ca             string            `long:"ca" description:"Specify a Certificate Authority"`
-	//Cert           string            `long:"cert" description:"Specify a Client SSL Certificate"`
-	//Key            string            `long:"key" description:"Specify a Client SSL Certificate's key"`
-	//Passphrase     string            `long:"passphrase" description:"Specify a Client SSL Certificate Key's passphrase. If you don't provide a value, it will be prompted for."`
-	EnableSlash bool `long:"slash" description:"Enable slash commands for control frames (/ping, /pong, /close [code [, reason]])"`
+	Origin               string            `short:"o" long:"origin" description:"optional origin"`
+	ExecuteCommand       string            `short:"x" long:"execute" description:"execute command after connecting"`
+	Wait                 int64             `short:"w" long:"wait" default:"2" description:" wait given seconds after executing command"`
+	InputFile            string            `long:"input-file" description:"send messages in the given JSON Lines file one by one, then quit"`
+	Replay               string            `long:"replay" description:"send the outbound frames recorded by --record in the given file, then report responses different from the recording"`
+	ReplaySpeed          float64           `long:"replay-speed" default:"1" description:"replay at the given times of the original speed, 0 means as fast as possible"`
+	Expect               string            `long:"expect" description:"with -x or --input-file, succeed when a message equal to the given text is received in --wait seconds"`
+	ExpectRegex          string            `long:"expect-regex" description:"with -x or --input-file, succeed when a message matching the given regex is received in --wait seconds"`
+	ExpectJson           string            `long:"expect-json" description:"with -x or --input-file, succeed when a JSON message with the value at the JSONPath is received in --wait seconds <$.path[=value]>"`
+	Host                 string            `long:"host" description:"optional host"`
+	NoTlsCheck           bool              `short:"n" long:"no-check" description:"Do not check for unauthorized certificates"`
+	Headers              map[string]string `short:"H" long:"header" description:"Set an HTTP header <header:value>. Repeat to set multiple like -H header1:value1 -H header2:value2."`
+	Auth                 string            `long:"auth" description:"Add basic HTTP authentication header <username:password>."`
+	Ca                   string            `long:"ca" description:"Specify a Certificate Authority in PEM or PKCS#12 format"`
+	Cert                 string            `long:"cert" description:"Specify a Client SSL Certificate in PEM or PKCS#12 format"`
+	Key                  string            `long:"key" description:"Specify a Client SSL Certificate's key. Can be omitted if the key is bundled in the certificate file"`
+	Passphrase           string            `long:"passphrase" description:"Specify a Client SSL Certificate Key's passphrase. If you don't provide a value, it will be prompted for."`
+	EnableSlash          bool              `long:"slash" description:"Enable slash commands for control frames (/ping, /pong, /close [code [, reason]])"`
+	Reconnect            bool              `long:"reconnect" description:"reconnect with exponential backoff when the connection is dropped by the server. Not supported with -x, --input-file or --replay"`
+	ReconnectMaxAttempts int               `long:"reconnect-max-attempts" default:"10" description:"give up reconnecting after given attempts, 0 means never give up"`
+	ReconnectBackoff     time.Duration     `long:"reconnect-backoff" default:"1s" description:"delay before the first reconnect attempt, doubled on each failed attempt"`
+	ReconnectMaxBackoff  time.Duration     `long:"reconnect-max-backoff" default:"30s" description:"max delay between reconnect attempts"`
+}
+
+type BenchOptions struct {
+	BenchConnections int           `long:"bench" description:"benchmark the server given by -c with the given number of connections, then print a summary"`
+	BenchRampUp      float64       `long:"bench-ramp-up" default:"0" description:"open given connections per second, 0 means all at once"`
+	BenchRate        float64       `long:"bench-rate" default:"1" description:"messages sent per second on each connection, 0 means none"`
+	BenchDuration    time.Duration `long:"bench-duration" default:"10s" description:"how long each connection sends messages"`
+	BenchMessage     string        `long:"bench-message" default:"{{conn}}-{{seq}}" description:"template of the messages sent. {{conn}}, {{seq}} and {{time}} are replaced by the connection number, the message number and the time in milliseconds"`
 }
 
 type CommandLineOptions struct {
 	ApplicationOptions
 	ListenOnPortOptions
 	ConnectOptions
+	BenchOptions
+
+	protoCodec *ProtoCodec
 }
 
 func parseCommandLineArguments() CommandLineOptions {
 	var appOpts ApplicationOptions
 	var listenOptions ListenOnPortOptions
 	var connectOptions ConnectOptions
+	var benchOptions BenchOptions
 	parser := flags.NewParser(&appOpts, flags.Default)
 
 	_, _ = parser.AddGroup(
@@ -54,6 +106,10 @@ func parseCommandLineArguments() CommandLineOptions {
 		"Connect To A WebSocket Server Options",
 		"Connect To A WebSocket Server Options",
 		&connectOptions)
+	_, _ = parser.AddGroup(
+		"Bench Options",
+		"Bench Options",
+		&benchOptions)
 	if _, err := parser.Parse(); err != nil {
 		switch flagsErr := err.(type) {
 		case *flags.Error:
@@ -78,18 +134,67 @@ func parseCommandLineArguments() CommandLineOptions {
 		SetLogger(noColorLogger)
 	}
 
+	if appOpts.CompressionLevel < flate.HuffmanOnly || appOpts.CompressionLevel > flate.BestCompression {
+		wsdogLogger.Fatalf("invalid compression level: %d", appOpts.CompressionLevel)
+	}
+
+	hasExpectation := len(connectOptions.Expect) > 0 || len(connectOptions.ExpectRegex) > 0 || len(connectOptions.ExpectJson) > 0
+	if hasExpectation && len(connectOptions.ExecuteCommand) == 0 && len(connectOptions.InputFile) == 0 {
+		wsdogLogger.Fatal("--expect, --expect-regex and --expect-json can only be used with -x or --input-file")
+	}
+	if connectOptions.Reconnect && (len(connectOptions.ExecuteCommand) > 0 || len(connectOptions.InputFile) > 0 || len(connectOptions.Replay) > 0) {
+		wsdogLogger.Fatal("--reconnect can only be used in the interactive console, not with -x, --input-file or --replay")
+	}
+
+	humanEventSink := HumanEventSink{binaryFormat: appOpts.BinaryFormat, proxy: len(listenOptions.Proxy) > 0}
+	if appOpts.Format == "json" {
+		if appOpts.NoColor {
+			humanEventSink.jsonPalette = noColorJsonPalette
+		} else {
+			humanEventSink.jsonPalette = defaultJsonPalette
+		}
+	}
+
+	var protoCodec *ProtoCodec
+	if len(appOpts.ProtoDescriptor) > 0 || len(appOpts.ProtoType) > 0 {
+		var err error
+		if protoCodec, err = LoadProtoCodec(appOpts.ProtoDescriptor, appOpts.ProtoType); err != nil {
+			wsdogLogger.Fatal(err)
+		}
+		humanEventSink.decoders = append(humanEventSink.decoders, protoCodec)
+	}
+	humanEventSink.decoders = append(humanEventSink.decoders, NewPayloadDecoders(appOpts.Decode)...)
+	SetEventSink(&humanEventSink)
+
+	if appOpts.Output == "jsonl" {
+		// every event is printed as JSON on stdout, so logs go to stderr
+		SetLogger(stderrLogger)
+		SetEventSink(&JsonLinesEventSink{})
+	}
+
+	if len(appOpts.Record) > 0 {
+		recorder, err := NewSessionRecorder(appOpts.Record)
+		if err != nil {
+			wsdogLogger.Fatal(err)
+		}
+		SetEventSink(MultiEventSink{wsdogEvents, recorder})
+	}
+
 	if appOpts.EnableDebug {
 		defaultLogger.EnableDebug()
 		noColorLogger.EnableDebug()
+		stderrLogger.EnableDebug()
 	}
 
-	return CommandLineOptions{appOpts, listenOptions, connectOptions}
+	return CommandLineOptions{appOpts, listenOptions, connectOptions, benchOptions, protoCodec}
 }
 
 func main() {
 	var cliOpts = parseCommandLineArguments()
 
-	if cliOpts.ConnectUrl != "" {
+	if cliOpts.ConnectUrl != "" && cliOpts.BenchConnections > 0 {
+		RunBench(cliOpts.ConnectUrl, cliOpts)
+	} else if cliOpts.ConnectUrl != "" {
 		RunAsClient(cliOpts.ConnectUrl, cliOpts)
 	} else {
 		RunAsServer(cliOpts.ListenPort, cliOpts)
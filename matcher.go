@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// MessageMatcher matches a received message. When JsonPath is set, the message is parsed as JSON and
+// Value or Regex is tested against the value at the path, or the path only needs to exist if
+// neither is set. Otherwise, Exact or Regex is tested against the whole message. An empty
+// MessageMatcher matches any message.
+type MessageMatcher struct {
+	Exact    *string `yaml:"exact"`
+	Regex    string  `yaml:"regex"`
+	JsonPath string  `yaml:"jsonPath"`
+	Value    *string `yaml:"value"`
+
+	regex    *regexp.Regexp
+	jsonPath *JsonPath
+}
+
+func (m *MessageMatcher) compile() error {
+	if m.Exact != nil && (len(m.Regex) > 0 || len(m.JsonPath) > 0) {
+		return errors.New("\"exact\" can not be used with \"regex\" or \"jsonPath\"")
+	}
+	if m.Value != nil && len(m.JsonPath) == 0 {
+		return errors.New("\"value\" can only be used with \"jsonPath\"")
+	}
+	if m.Value != nil && len(m.Regex) > 0 {
+		return errors.New("\"value\" can not be used with \"regex\"")
+	}
+
+	var err error
+	if len(m.Regex) > 0 {
+		if m.regex, err = regexp.Compile(m.Regex); err != nil {
+			return fmt.Errorf("invalid regex \"%s\": %s", m.Regex, err)
+		}
+	}
+	if len(m.JsonPath) > 0 {
+		if m.jsonPath, err = CompileJsonPath(m.JsonPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match returns the text tested by the regex and its capturing groups if the message matches.
+func (m *MessageMatcher) match(payload []byte) ([]byte, []int, bool) {
+	target := payload
+	if m.jsonPath != nil {
+		var doc interface{}
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return nil, nil, false
+		}
+		value, ok := m.jsonPath.LookupString(doc)
+		if !ok {
+			return nil, nil, false
+		}
+		if m.Value != nil {
+			return nil, nil, value == *m.Value
+		}
+		target = []byte(value)
+	}
+
+	if m.Exact != nil {
+		return nil, nil, string(target) == *m.Exact
+	}
+	if m.regex != nil {
+		groups := m.regex.FindSubmatchIndex(target)
+		return target, groups, groups != nil
+	}
+	return nil, nil, true
+}
+
+func (m *MessageMatcher) String() string {
+	switch {
+	case m.Exact != nil:
+		return fmt.Sprintf("message equal to \"%s\"", *m.Exact)
+	case len(m.JsonPath) > 0 && m.Value != nil:
+		return fmt.Sprintf("message with \"%s\" at %s", *m.Value, m.JsonPath)
+	case len(m.JsonPath) > 0 && len(m.Regex) > 0:
+		return fmt.Sprintf("message with value matching /%s/ at %s", m.Regex, m.JsonPath)
+	case len(m.JsonPath) > 0:
+		return fmt.Sprintf("message with %s", m.JsonPath)
+	case len(m.Regex) > 0:
+		return fmt.Sprintf("message matching /%s/", m.Regex)
+	}
+	return "any message"
+}
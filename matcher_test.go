@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestMessageMatcherCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher MessageMatcher
+		wantErr bool
+	}{
+		{"empty", MessageMatcher{}, false},
+		{"exact", MessageMatcher{Exact: strPtr("hi")}, false},
+		{"regex", MessageMatcher{Regex: "^hi"}, false},
+		{"json path with value", MessageMatcher{JsonPath: "$.type", Value: strPtr("ack")}, false},
+		{"json path with regex", MessageMatcher{JsonPath: "$.type", Regex: "^a"}, false},
+		{"exact with regex", MessageMatcher{Exact: strPtr("hi"), Regex: "hi"}, true},
+		{"exact with json path", MessageMatcher{Exact: strPtr("hi"), JsonPath: "$.a"}, true},
+		{"value without json path", MessageMatcher{Value: strPtr("ack")}, true},
+		{"value with regex", MessageMatcher{JsonPath: "$.type", Value: strPtr("ack"), Regex: "a"}, true},
+		{"invalid regex", MessageMatcher{Regex: "("}, true},
+		{"invalid json path", MessageMatcher{JsonPath: "type"}, true},
+	}
+	for _, test := range tests {
+		err := test.matcher.compile()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: compile() error = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestMessageMatcherMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		matcher    MessageMatcher
+		payload    string
+		want       bool
+		wantTarget string
+	}{
+		{"empty matches anything", MessageMatcher{}, "whatever", true, ""},
+		{"exact", MessageMatcher{Exact: strPtr("hi")}, "hi", true, ""},
+		{"exact mismatch", MessageMatcher{Exact: strPtr("hi")}, "hi!", false, ""},
+		{"regex", MessageMatcher{Regex: "^hello (.*)$"}, "hello bob", true, "hello bob"},
+		{"regex mismatch", MessageMatcher{Regex: "^hello"}, "bye", false, ""},
+		{"json path value", MessageMatcher{JsonPath: "$.type", Value: strPtr("ack")}, `{"type":"ack"}`, true, ""},
+		{"json path value mismatch", MessageMatcher{JsonPath: "$.type", Value: strPtr("ack")}, `{"type":"nack"}`, false, ""},
+		{"json path number value", MessageMatcher{JsonPath: "$.n", Value: strPtr("1")}, `{"n":1}`, true, ""},
+		{"json path exists", MessageMatcher{JsonPath: "$.type"}, `{"type":"x"}`, true, ""},
+		{"json path missing", MessageMatcher{JsonPath: "$.type"}, `{"kind":"x"}`, false, ""},
+		{"json path regex", MessageMatcher{JsonPath: "$.user.name", Regex: "^a(.)"}, `{"user":{"name":"alice"}}`, true, "alice"},
+		{"not json", MessageMatcher{JsonPath: "$.type"}, "type", false, ""},
+	}
+	for _, test := range tests {
+		if err := test.matcher.compile(); err != nil {
+			t.Fatalf("%s: compile() failed: %s", test.name, err)
+		}
+		target, _, ok := test.matcher.match([]byte(test.payload))
+		if ok != test.want {
+			t.Errorf("%s: match(%q) = %v, want %v", test.name, test.payload, ok, test.want)
+		}
+		if ok && string(target) != test.wantTarget {
+			t.Errorf("%s: match(%q) target = %q, want %q", test.name, test.payload, target, test.wantTarget)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+// MockRules describes how the server replies to received messages. It's loaded from a YAML
+// or a JSON file given by --rules, like:
+//
+//	pushes:
+//	  - delay: 1s
+//	    text: welcome
+//	rules:
+//	  - match:
+//	      regex: "^hello (.*)$"
+//	    responses:
+//	      - text: "hi ${1}"
+//	        delay: 100ms
+//	  - match:
+//	      jsonPath: $.type
+//	      value: bye
+//	    close:
+//	      code: 4000
+//	      reason: see you
+type MockRules struct {
+	Rules  []*MockRule `yaml:"rules"`
+	Pushes []*MockPush `yaml:"pushes"`
+}
+
+type MockRule struct {
+	Match     MessageMatcher  `yaml:"match"`
+	Responses []*MockResponse `yaml:"responses"`
+	Close     *MockClose      `yaml:"close"`
+}
+
+// MockResponse is a message written to the client after Delay. Text can refer to the capturing
+// groups of the regex which matched the received message like "${1}".
+type MockResponse struct {
+	Delay  time.Duration `yaml:"delay"`
+	Text   *string       `yaml:"text"`
+	Binary string        `yaml:"binary"`
+
+	binary []byte
+}
+
+type MockClose struct {
+	Delay  time.Duration `yaml:"delay"`
+	Code   int           `yaml:"code"`
+	Reason string        `yaml:"reason"`
+}
+
+// MockPush is a message the server sends by itself Delay after the client connected. It's
+// repeated Every given duration for Times, or until the connection is closed if Times is 0.
+type MockPush struct {
+	MockResponse `yaml:",inline"`
+	Every        time.Duration `yaml:"every"`
+	Times        int           `yaml:"times"`
+}
+
+func LoadMockRules(path string) (*MockRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rules file \"%s\" failed: %s", path, err)
+	}
+
+	// JSON is a subset of YAML, so one parser serves both formats
+	var rules MockRules
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse rules file \"%s\" failed: %s", path, err)
+	}
+
+	for i, rule := range rules.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule #%d in \"%s\": %s", i+1, path, err)
+		}
+	}
+	for i, push := range rules.Pushes {
+		if err := push.compile(); err != nil {
+			return nil, fmt.Errorf("invalid push #%d in \"%s\": %s", i+1, path, err)
+		}
+	}
+	return &rules, nil
+}
+
+func (r *MockRule) compile() error {
+	if err := r.Match.compile(); err != nil {
+		return err
+	}
+
+	for _, resp := range r.Responses {
+		if err := resp.compile(); err != nil {
+			return err
+		}
+	}
+	if len(r.Responses) == 0 && r.Close == nil {
+		return errors.New("at least one of \"responses\" or \"close\" is required")
+	}
+	return nil
+}
+
+func (r *MockResponse) compile() error {
+	if r.Text != nil && len(r.Binary) > 0 {
+		return errors.New("a response can not have both \"text\" and \"binary\"")
+	}
+	if r.Text == nil && len(r.Binary) == 0 {
+		return errors.New("a response requires \"text\" or \"binary\"")
+	}
+	if len(r.Binary) > 0 {
+		var err error
+		if r.binary, err = base64.StdEncoding.DecodeString(r.Binary); err != nil {
+			return fmt.Errorf("invalid string in Base64: \"%s\"", r.Binary)
+		}
+	}
+	return nil
+}
+
+func (p *MockPush) compile() error {
+	if p.Times > 0 && p.Every <= 0 {
+		return errors.New("\"times\" requires \"every\"")
+	}
+	return p.MockResponse.compile()
+}
+
+func (r *MockResponse) payload(regex *regexp.Regexp, matched []byte, groups []int) (int, []byte) {
+	if r.Text == nil {
+		return websocket.BinaryMessage, r.binary
+	}
+	if regex == nil || len(groups) == 0 {
+		return websocket.TextMessage, []byte(*r.Text)
+	}
+	return websocket.TextMessage, regex.Expand(nil, []byte(*r.Text), matched, groups)
+}
+
+// Reply writes the responses of the first rule matching the message, and closes the connection if the
+// rule says so. It returns whether any rule matched. A rule with delays is carried out by its own
+// goroutine until done is closed, so the connection keeps being read while the rule waits.
+func (rules *MockRules) Reply(c *ServerConn, message *WebSocketMessage, done chan struct{}) bool {
+	for _, rule := range rules.Rules {
+		target, groups, ok := rule.Match.match(message.payload)
+		if !ok {
+			continue
+		}
+		if rule.delayed() {
+			go rule.reply(c, target, groups, done)
+		} else {
+			rule.reply(c, target, groups, done)
+		}
+		return true
+	}
+	return false
+}
+
+func (r *MockRule) delayed() bool {
+	for _, resp := range r.Responses {
+		if resp.Delay > 0 {
+			return true
+		}
+	}
+	return r.Close != nil && r.Close.Delay > 0
+}
+
+// reply writes the responses of the rule to the client one by one, then closes the connection if
+// the rule says so. It gives up when done is closed.
+func (r *MockRule) reply(c *ServerConn, target []byte, groups []int, done chan struct{}) {
+	for _, resp := range r.Responses {
+		if !sleepUnlessDone(resp.Delay, done) {
+			return
+		}
+		messageType, payload := resp.payload(r.Match.regex, target, groups)
+		wsdogLogger.Debugf("write message to client %d: %s", c.id, payload)
+		if err := c.writeMessage(messageType, payload); err != nil {
+			wsdogLogger.Errorf("write to client %d failed: %s", c.id, err)
+			return
+		}
+	}
+
+	if r.Close == nil || !sleepUnlessDone(r.Close.Delay, done) {
+		return
+	}
+	code := r.Close.Code
+	if code == 0 {
+		code = defaultCloseStatusCode
+	}
+	if err := c.closeGracefully(code, r.Close.Reason); err != nil {
+		wsdogLogger.Errorf("write close frame to client %d failed: %s", c.id, err)
+	}
+}
+
+// sleepUnlessDone waits for the duration and returns false if done is closed meanwhile.
+func sleepUnlessDone(d time.Duration, done chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// RunPushes writes the pushes to the client until they are all done or the connection is closed.
+func (rules *MockRules) RunPushes(c *ServerConn, done chan struct{}) {
+	for _, push := range rules.Pushes {
+		go push.run(c, done)
+	}
+}
+
+func (p *MockPush) run(c *ServerConn, done chan struct{}) {
+	wait := p.Delay
+	for sent := 0; p.Times <= 0 || sent < p.Times; sent++ {
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		messageType, payload := p.payload(nil, nil, nil)
+		wsdogLogger.Debugf("push message to client %d: %s", c.id, payload)
+		if err := c.writeMessage(messageType, payload); err != nil {
+			wsdogLogger.Errorf("push to client %d failed: %s", c.id, err)
+			return
+		}
+		if p.Every <= 0 {
+			return
+		}
+		wait = p.Every
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMockRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"yaml", "rules:\n  - match:\n      regex: \"^hello (.*)$\"\n    responses:\n      - text: \"hi ${1}\"\n        delay: 100ms\n", false},
+		{"json", `{"rules": [{"match": {"jsonPath": "$.type", "value": "bye"}, "close": {"code": 4000}}]}`, false},
+		{"push", "pushes:\n  - text: tick\n    every: 1s\n    times: 3\n", false},
+		{"unknown field", "rules:\n  - match: {exact: hi}\n    reply: hi\n", true},
+		{"no response nor close", "rules:\n  - match: {exact: hi}\n", true},
+		{"text and binary", "rules:\n  - responses:\n      - text: hi\n        binary: aGk=\n", true},
+		{"invalid base64", "rules:\n  - responses:\n      - binary: \"!!\"\n", true},
+		{"times without every", "pushes:\n  - text: tick\n    times: 3\n", true},
+		{"invalid matcher", "rules:\n  - match: {regex: \"(\"}\n    responses:\n      - text: hi\n", true},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, "rules.yaml")
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadMockRules(path)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: LoadMockRules() error = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestMockResponsePayload(t *testing.T) {
+	rules := MockRules{Rules: []*MockRule{{
+		Match:     MessageMatcher{Regex: "^hello (.*)$"},
+		Responses: []*MockResponse{{Text: strPtr("hi ${1}")}},
+	}}}
+	if err := rules.Rules[0].compile(); err != nil {
+		t.Fatal(err)
+	}
+	rule := rules.Rules[0]
+	target, groups, ok := rule.Match.match([]byte("hello bob"))
+	if !ok {
+		t.Fatal("rule does not match")
+	}
+	if _, payload := rule.Responses[0].payload(rule.Match.regex, target, groups); string(payload) != "hi bob" {
+		t.Errorf("payload = %q, want %q", payload, "hi bob")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	NoDecode      = "none"
+	AutoDecode    = "auto"
+	MsgpackDecode = "msgpack"
+	CborDecode    = "cbor"
+)
+
+// PayloadCodec converts the payload of Binary Messages in some format from and to JSON.
+type PayloadCodec interface {
+	Name() string
+	// Decode returns the payload in compact JSON
+	Decode(payload []byte) ([]byte, error)
+	// Encode returns the JSON input in the format of the codec
+	Encode(input []byte) ([]byte, error)
+}
+
+// MsgpackCodec converts MessagePack from and to JSON. When autodetected is true, only
+// payloads with a map or an array on the top level are decoded, because nearly any
+// payload is a valid MessagePack value otherwise.
+type MsgpackCodec struct {
+	autodetected bool
+}
+
+// CborCodec converts CBOR from and to JSON. Like MsgpackCodec, autodetected codec only
+// decodes payloads with a map or an array on the top level.
+type CborCodec struct {
+	autodetected bool
+}
+
+// NewPayloadDecoders returns the codecs to decode received Binary Messages in the given mode.
+// In auto mode, a payload is tried as MessagePack first, then as CBOR.
+func NewPayloadDecoders(mode string) []PayloadCodec {
+	switch mode {
+	case AutoDecode:
+		return []PayloadCodec{&MsgpackCodec{autodetected: true}, &CborCodec{autodetected: true}}
+	case MsgpackDecode:
+		return []PayloadCodec{&MsgpackCodec{}}
+	case CborDecode:
+		return []PayloadCodec{&CborCodec{}}
+	}
+	return nil
+}
+
+func (c *MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (c *MsgpackCodec) Decode(payload []byte) ([]byte, error) {
+	reader := bytes.NewReader(payload)
+	decoder := msgpack.NewDecoder(reader)
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return nil, fmt.Errorf("decode as msgpack failed: %s", err)
+	}
+	if reader.Len() > 0 {
+		return nil, fmt.Errorf("decode as msgpack failed: %d bytes left after the first value", reader.Len())
+	}
+	return marshalDecodedValue(c.Name(), value, c.autodetected)
+}
+
+func (c *MsgpackCodec) Encode(input []byte) ([]byte, error) {
+	value, err := unmarshalJsonInput(input)
+	if err != nil {
+		return nil, fmt.Errorf("encode as msgpack failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetSortMapKeys(true)
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(value); err != nil {
+		return nil, fmt.Errorf("encode as msgpack failed: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *CborCodec) Name() string {
+	return "cbor"
+}
+
+func (c *CborCodec) Decode(payload []byte) ([]byte, error) {
+	decoder := cbor.NewDecoder(bytes.NewReader(payload))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("decode as cbor failed: %s", err)
+	}
+	if left := len(payload) - decoder.NumBytesRead(); left > 0 {
+		return nil, fmt.Errorf("decode as cbor failed: %d bytes left after the first value", left)
+	}
+	return marshalDecodedValue(c.Name(), value, c.autodetected)
+}
+
+func (c *CborCodec) Encode(input []byte) ([]byte, error) {
+	value, err := unmarshalJsonInput(input)
+	if err != nil {
+		return nil, fmt.Errorf("encode as cbor failed: %s", err)
+	}
+
+	encMode, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	bs, err := encMode.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("encode as cbor failed: %s", err)
+	}
+	return bs, nil
+}
+
+func marshalDecodedValue(name string, value interface{}, containerOnly bool) ([]byte, error) {
+	value = toJsonValue(value)
+	if containerOnly {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			return nil, fmt.Errorf("decode as %s failed: not a map or an array", name)
+		}
+	}
+
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("decode as %s failed: %s", name, err)
+	}
+	return bs, nil
+}
+
+// toJsonValue converts maps with keys of any type, which JSON does not support, to maps with keys
+// in string recursively.
+func toJsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = toJsonValue(elem)
+		}
+		return m
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = toJsonValue(elem)
+		}
+		return v
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = toJsonValue(elem)
+		}
+		return v
+	}
+	return value
+}
+
+// unmarshalJsonInput parses the input in JSON, keeping integers as int64 instead of float64
+// so they are encoded as integers.
+func unmarshalJsonInput(input []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid JSON: more than one value")
+	}
+	return fromJsonNumbers(value), nil
+}
+
+func fromJsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = fromJsonNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fromJsonNumbers(elem)
+		}
+	}
+	return value
+}
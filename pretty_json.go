@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/fatih/color"
+	"io"
+	"strings"
+)
+
+// JsonPalette colors the parts of a pretty-printed JSON.
+type JsonPalette struct {
+	key     *color.Color
+	str     *color.Color
+	literal *color.Color
+}
+
+func plainColor() *color.Color {
+	c := color.New()
+	c.DisableColor()
+	return c
+}
+
+var (
+	defaultJsonPalette = &JsonPalette{
+		key:     color.New(color.FgBlue),
+		str:     color.New(color.FgGreen),
+		literal: color.New(color.FgYellow),
+	}
+	noColorJsonPalette = &JsonPalette{
+		key:     plainColor(),
+		str:     plainColor(),
+		literal: plainColor(),
+	}
+)
+
+// jsonContainer is an object or an array being printed.
+type jsonContainer struct {
+	isObject  bool
+	empty     bool
+	expectKey bool
+}
+
+// prettyJson indents a JSON document and colors its keys and values with the palette. The order
+// of keys is kept. It returns false if the payload is not a JSON object or array.
+func prettyJson(payload []byte, palette *JsonPalette) (string, bool) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') || !json.Valid(trimmed) {
+		return "", false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+
+	var sb strings.Builder
+	var stack []*jsonContainer
+	newLine := func() {
+		sb.WriteString("\n")
+		sb.WriteString(strings.Repeat(prettyJsonIndent, len(stack)))
+	}
+	// beforeValue writes the separator before an element of the current container
+	beforeValue := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.isObject && !top.expectKey {
+			return
+		}
+		if !top.empty {
+			sb.WriteString(",")
+		}
+		top.empty = false
+		newLine()
+	}
+	afterValue := func() {
+		if len(stack) > 0 && stack[len(stack)-1].isObject {
+			stack[len(stack)-1].expectKey = !stack[len(stack)-1].expectKey
+		}
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", false
+		}
+
+		switch v := token.(type) {
+		case json.Delim:
+			switch v {
+			case '{', '[':
+				beforeValue()
+				sb.WriteString(v.String())
+				stack = append(stack, &jsonContainer{isObject: v == '{', empty: true, expectKey: true})
+			case '}', ']':
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if !top.empty {
+					newLine()
+				}
+				sb.WriteString(v.String())
+				afterValue()
+			}
+		case string:
+			quoted := quoteJsonString(v)
+			if len(stack) > 0 && stack[len(stack)-1].isObject && stack[len(stack)-1].expectKey {
+				beforeValue()
+				sb.WriteString(palette.key.Sprint(quoted))
+				sb.WriteString(": ")
+				stack[len(stack)-1].expectKey = false
+				continue
+			}
+			beforeValue()
+			sb.WriteString(palette.str.Sprint(quoted))
+			afterValue()
+		case json.Number:
+			beforeValue()
+			sb.WriteString(palette.literal.Sprint(v.String()))
+			afterValue()
+		case bool:
+			beforeValue()
+			if v {
+				sb.WriteString(palette.literal.Sprint("true"))
+			} else {
+				sb.WriteString(palette.literal.Sprint("false"))
+			}
+			afterValue()
+		case nil:
+			beforeValue()
+			sb.WriteString(palette.literal.Sprint("null"))
+			afterValue()
+		}
+	}
+	return sb.String(), true
+}
+
+// quoteJsonString quotes the string like encoding/json but keeps characters like '<' as they are.
+func quoteJsonString(s string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		panic(err)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestPrettyJson(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+		ok      bool
+	}{
+		{`{}`, `{}`, true},
+		{`[]`, `[]`, true},
+		{`{"b":1,"a":[true,null,"x<y"]}`, `{
+  "b": 1,
+  "a": [
+    true,
+    null,
+    "x<y"
+  ]
+}`, true},
+		{` {"a":{}, "n": 1.50e3} `, `{
+  "a": {},
+  "n": 1.50e3
+}`, true},
+		{`[[1],{"k":"v","e":[]},false]`, `[
+  [
+    1
+  ],
+  {
+    "k": "v",
+    "e": []
+  },
+  false
+]`, true},
+		{`{"quote\"d":"line\nbreak"}`, `{
+  "quote\"d": "line\nbreak"
+}`, true},
+		{``, ``, false},
+		{`hello`, ``, false},
+		{`"hello"`, ``, false},
+		{`123`, ``, false},
+		{`{"a":}`, ``, false},
+		{`[1,2`, ``, false},
+		{`{} {}`, ``, false},
+	}
+	for _, test := range tests {
+		got, ok := prettyJson([]byte(test.payload), noColorJsonPalette)
+		if ok != test.ok || got != test.want {
+			t.Errorf("prettyJson(%q) = %q, %v, want %q, %v", test.payload, got, ok, test.want, test.ok)
+		}
+	}
+}
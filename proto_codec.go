@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/ioutil"
+)
+
+// ProtoCodec converts between a protobuf message type and its JSON form. The message type is
+// looked up in a FileDescriptorSet compiled by something like:
+//
+//	protoc --include_imports --descriptor_set_out=service.desc service.proto
+type ProtoCodec struct {
+	descriptor protoreflect.MessageDescriptor
+}
+
+func LoadProtoCodec(descriptorPath string, messageType string) (*ProtoCodec, error) {
+	if len(descriptorPath) == 0 || len(messageType) == 0 {
+		return nil, errors.New("--proto-descriptor and --proto-type must be provided together")
+	}
+
+	data, err := ioutil.ReadFile(descriptorPath)
+	if err != nil {
+		return nil, fmt.Errorf("read descriptor set \"%s\" failed: %s", descriptorPath, err)
+	}
+
+	var descriptorSet descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &descriptorSet); err != nil {
+		return nil, fmt.Errorf("parse descriptor set \"%s\" failed: %s", descriptorPath, err)
+	}
+	files, err := protodesc.NewFiles(&descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("load descriptor set \"%s\" failed: %s. Please make sure it's compiled with --include_imports", descriptorPath, err)
+	}
+
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(messageType))
+	if err != nil {
+		return nil, fmt.Errorf("message type \"%s\" not found in \"%s\"", messageType, descriptorPath)
+	}
+	messageDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("\"%s\" in \"%s\" is not a message type", messageType, descriptorPath)
+	}
+	return &ProtoCodec{descriptor: messageDesc}, nil
+}
+
+func (c *ProtoCodec) Name() string {
+	return string(c.descriptor.FullName())
+}
+
+// Decode parses the payload as the message type and returns it in compact JSON.
+func (c *ProtoCodec) Decode(payload []byte) ([]byte, error) {
+	message := dynamicpb.NewMessage(c.descriptor)
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return nil, fmt.Errorf("decode as %s failed: %s", c.Name(), err)
+	}
+	bs, err := protojson.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("decode as %s failed: %s", c.Name(), err)
+	}
+
+	// protojson randomly adds spaces to its output on purpose, so compact it to make the output stable
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, bs); err != nil {
+		return nil, fmt.Errorf("decode as %s failed: %s", c.Name(), err)
+	}
+	return compacted.Bytes(), nil
+}
+
+// Encode parses the input in JSON as the message type and returns it in protobuf wire format.
+func (c *ProtoCodec) Encode(input []byte) ([]byte, error) {
+	message := dynamicpb.NewMessage(c.descriptor)
+	if err := protojson.Unmarshal(input, message); err != nil {
+		return nil, fmt.Errorf("encode as %s failed: %s", c.Name(), err)
+	}
+	bs, err := proto.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("encode as %s failed: %s", c.Name(), err)
+	}
+	return bs, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// forwardedProxyHeaders are copied from the request of the client to the request to the upstream
+// server, unless they are set by the connect options like -H or --auth.
+var forwardedProxyHeaders = []string{"Origin", "Cookie", "Authorization", "User-Agent"}
+
+// ProxyConn is a connection from a client relayed to the upstream server in proxy mode. Frames
+// from the client are reported as received on the connection, and frames from the upstream server
+// as sent on the connection. Both are reported as soon as they are read, before they are held by
+// breakpoints, and reported again if they are forwarded edited.
+type ProxyConn struct {
+	client   *ServerConn
+	upstream *websocket.Conn
+	// upstreamWriteMu serializes writes to the upstream server like ServerConn.writeMu
+	upstreamWriteMu sync.Mutex
+	showPingPong    bool
+	breakpoints     *ProxyBreakpoints
+	// closing is closed when either side is closed, to drop the held frames of the connection
+	closing chan struct{}
+
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+}
+
+// proxiedUrl returns the URL to dial for a request. The path and the query of the request are
+// kept if the upstream URL has no path.
+func proxiedUrl(upstream *url.URL, r *http.Request) *url.URL {
+	u := *upstream
+	if len(u.Path) == 0 || u.Path == "/" {
+		u.Path = r.URL.Path
+		u.RawPath = r.URL.RawPath
+		u.RawQuery = r.URL.RawQuery
+	}
+	return &u
+}
+
+func (p *ProxyConn) writeUpstream(messageType int, payload []byte) error {
+	p.upstreamWriteMu.Lock()
+	defer p.upstreamWriteMu.Unlock()
+	if err := p.upstream.SetWriteDeadline(time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		return err
+	}
+	return p.upstream.WriteMessage(messageType, payload)
+}
+
+// closed remembers how the connection was closed by the first side which closed it.
+func (p *ProxyConn) closed(code int, text string) {
+	p.closeOnce.Do(func() {
+		p.closeCode = code
+		p.closeText = text
+	})
+}
+
+// setupControlHandlers forwards ping, pong and close frames to the other side.
+func (p *ProxyConn) setupControlHandlers() {
+	id := p.client.id
+	// direction is "client >" for frames from the client, or "server <" for frames from the upstream server
+	forward := func(direction string, messageType int, payload []byte, write func(int, []byte) error) error {
+		if p.showPingPong && messageType != websocket.CloseMessage {
+			wsdogLogger.Okf("%s%s %s frame", connPrefix(id), direction, opcodeName(messageType))
+		}
+		if err := write(messageType, payload); err != nil {
+			wsdogLogger.Debugf("forward %s frame of connection %d failed: %s", opcodeName(messageType), id, err)
+		}
+		return nil
+	}
+	toUpstream := func(messageType int, payload []byte) error {
+		return p.upstream.WriteControl(messageType, payload, time.Now().Add(defaultWriteWaitDuration))
+	}
+
+	p.client.conn.SetPingHandler(func(message string) error {
+		wsdogEvents.Received(id, websocket.PingMessage, []byte(message))
+		return forward("client >", websocket.PingMessage, []byte(message), toUpstream)
+	})
+	p.client.conn.SetPongHandler(func(message string) error {
+		wsdogEvents.Received(id, websocket.PongMessage, []byte(message))
+		return forward("client >", websocket.PongMessage, []byte(message), toUpstream)
+	})
+	p.client.conn.SetCloseHandler(func(code int, text string) error {
+		wsdogLogger.Okf("%sclient > close frame (code: %d, reason %s)", connPrefix(id), code, text)
+		wsdogEvents.Received(id, websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+		p.closed(code, text)
+		return forward("client >", websocket.CloseMessage, websocket.FormatCloseMessage(code, text), toUpstream)
+	})
+
+	p.upstream.SetPingHandler(func(message string) error {
+		return forward("server <", websocket.PingMessage, []byte(message), p.client.writeControl)
+	})
+	p.upstream.SetPongHandler(func(message string) error {
+		return forward("server <", websocket.PongMessage, []byte(message), p.client.writeControl)
+	})
+	p.upstream.SetCloseHandler(func(code int, text string) error {
+		wsdogLogger.Okf("%sserver < close frame (code: %d, reason %s)", connPrefix(id), code, text)
+		p.closed(code, text)
+		if err := p.client.closeGracefully(code, text); err != nil {
+			wsdogLogger.Debugf("forward close frame of connection %d failed: %s", id, err)
+		}
+		return nil
+	})
+}
+
+// pump reads messages from one side and writes them to the other until either side fails.
+// Messages matching the breakpoints are held until they are released from the console.
+func (p *ProxyConn) pump(from *websocket.Conn, fromClient bool, write func(int, []byte) error, report func(int, []byte)) {
+	for {
+		messageType, payload, err := from.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				p.closed(websocket.CloseAbnormalClosure, err.Error())
+			}
+			return
+		}
+		report(messageType, payload)
+		if p.breakpoints != nil {
+			released, forward := p.breakpoints.hold(p.client.id, fromClient, messageType, payload, p.closing)
+			if !forward {
+				continue
+			}
+			if !bytes.Equal(released, payload) {
+				report(messageType, released)
+				payload = released
+			}
+		}
+		if err := write(messageType, payload); err != nil {
+			p.closed(websocket.CloseAbnormalClosure, err.Error())
+			return
+		}
+	}
+}
+
+// run relays the frames in both directions until one side closes the connection, then closes the other side.
+func (p *ProxyConn) run() {
+	p.setupControlHandlers()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		p.pump(p.client.conn, true, p.writeUpstream, func(messageType int, payload []byte) {
+			wsdogEvents.Received(p.client.id, messageType, payload)
+		})
+		done <- struct{}{}
+	}()
+	go func() {
+		p.pump(p.upstream, false, p.client.writeUnreported, func(messageType int, payload []byte) {
+			wsdogEvents.Sent(p.client.id, messageType, payload)
+		})
+		done <- struct{}{}
+	}()
+
+	<-done
+	close(p.closing)
+	// a close frame from the client is forwarded to the upstream server, which is waited for
+	// a while to reply it. One from the upstream server closes the client by closeGracefully.
+	select {
+	case <-done:
+	case <-time.After(defaultWriteWaitDuration):
+	}
+	closeConn(p.client.conn)
+	closeConn(p.upstream)
+}
+
+func generateProxyHandler(opts CommandLineOptions, registry *ServerConnRegistry, proxyConns *ProxyConns, breakpoints *ProxyBreakpoints, upstream *url.URL) func(w http.ResponseWriter, r *http.Request) {
+	dialer := newDialer(opts)
+	headers := buildConnectHeaders(opts)
+	// the client is often a browser loading the page from the upstream server, so any origin is accepted
+	upgrader := websocket.Upgrader{HandshakeTimeout: defaultHandshakeTimeout, EnableCompression: opts.Compression, CheckOrigin: func(r *http.Request) bool { return true }}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.VerboseHandshake {
+			wsdogLogger.Okf("Upgrade request to %s from %s", r.URL.Path, r.RemoteAddr)
+			printHandshakeRequest("< ", r)
+		}
+
+		upstreamUrl := proxiedUrl(upstream, r)
+		upstreamHeaders := headers.Clone()
+		for _, name := range forwardedProxyHeaders {
+			if len(upstreamHeaders.Get(name)) == 0 && len(r.Header.Get(name)) > 0 {
+				upstreamHeaders[name] = r.Header.Values(name)
+			}
+		}
+		upstreamDialer := dialer
+		upstreamDialer.Subprotocols = requestedSubprotocols(r.Header)
+
+		upstreamConn, resp, err := upstreamDialer.Dial(upstreamUrl.String(), upstreamHeaders)
+		if opts.VerboseHandshake && resp != nil {
+			printHandshake(resp)
+		}
+		if err != nil {
+			status := http.StatusBadGateway
+			if err == websocket.ErrBadHandshake && resp != nil {
+				status = resp.StatusCode
+				err = fmt.Errorf("%s (status: %s)", err, resp.Status)
+			} else {
+				err = fmt.Errorf("%s", describeTlsError(err))
+			}
+			http.Error(w, http.StatusText(status), status)
+			wsdogLogger.Errorf("connect to upstream \"%s\" for %s failed: %s", upstreamUrl, r.RemoteAddr, err)
+			return
+		}
+
+		responseHeader := http.Header{}
+		if len(upstreamConn.Subprotocol()) > 0 {
+			responseHeader.Set(subprotocolHeader, upstreamConn.Subprotocol())
+		}
+		recorder := &handshakeRecorder{ResponseWriter: w}
+		conn, err := upgrader.Upgrade(recorder, r, responseHeader)
+		if err != nil {
+			if opts.VerboseHandshake && recorder.status > 0 {
+				recorder.printResponse(r)
+			}
+			wsdogLogger.Errorf("websocket upgrade failed: %s", err.Error())
+			closeConn(upstreamConn)
+			return
+		}
+		if opts.VerboseHandshake {
+			if resp, err := recorder.upgradeResponse(r); err != nil {
+				wsdogLogger.Debugf("parse upgrade response failed: %s", err)
+			} else {
+				printUpgradeResponse(resp)
+			}
+		}
+
+		serverConn := registry.add(conn, r.URL.Path)
+		wsdogLogger.Okf("Client %d connected to %s (from %s), relayed to %s", serverConn.id, serverConn.path, conn.RemoteAddr(), upstreamUrl)
+		wsdogEvents.Connected(serverConn.id, conn.RemoteAddr().String())
+		if len(upstreamConn.Subprotocol()) > 0 {
+			wsdogLogger.Okf("Client %d uses subprotocol %s", serverConn.id, upstreamConn.Subprotocol())
+		}
+
+		proxyConn := &ProxyConn{client: serverConn, upstream: upstreamConn, showPingPong: opts.ShowPingPong, breakpoints: breakpoints, closing: make(chan struct{})}
+		proxyConns.add(proxyConn)
+		proxyConn.run()
+
+		proxyConns.remove(proxyConn)
+		registry.remove(serverConn)
+		wsdogLogger.Okf("Client %d left %s (code: %d, reason: \"%s\")", serverConn.id, serverConn.path, proxyConn.closeCode, proxyConn.closeText)
+		wsdogEvents.Disconnected(serverConn.id, proxyConn.closeCode, proxyConn.closeText)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ToClientCommand CommandType = "to-client"
+	ToServerCommand             = "to-server"
+	BreakCommand                = "break"
+	HeldCommand                 = "held"
+	ForwardCommand              = "forward"
+	DropCommand                 = "drop"
+	EditCommand                 = "edit"
+)
+
+const (
+	BreakOnBoth   = "both"
+	BreakOnClient = "client"
+	BreakOnServer = "server"
+)
+
+// heldDecision tells what to do with a held frame. payload replaces the one of the frame if it's not nil.
+type heldDecision struct {
+	forward bool
+	payload []byte
+}
+
+// HeldFrame is a frame stopped at a breakpoint in proxy mode, waiting for the operator to forward,
+// edit or drop it. The frames after it in the same direction of the connection wait too.
+type HeldFrame struct {
+	id          uint64
+	connId      uint64
+	fromClient  bool
+	messageType int
+	payload     []byte
+	decision    chan heldDecision
+}
+
+func (f *HeldFrame) String() string {
+	direction := "server <"
+	if f.fromClient {
+		direction = "client >"
+	}
+	payload := string(f.payload)
+	if f.messageType == websocket.BinaryMessage {
+		direction += direction[len(direction)-1:]
+		payload = base64.StdEncoding.EncodeToString(f.payload)
+	}
+	return fmt.Sprintf("#%d: %s%s %s", f.id, connPrefix(f.connId), direction, payload)
+}
+
+// ProxyBreakpoints holds the Text and Binary Messages in proxy mode which match the regex and come
+// from the side given by direction, until they are released from the console.
+type ProxyBreakpoints struct {
+	mu        sync.Mutex
+	regex     *regexp.Regexp
+	direction string
+	nextId    uint64
+	held      []*HeldFrame
+}
+
+func (b *ProxyBreakpoints) set(pattern string, direction string) error {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regex \"%s\": %s", pattern, err)
+	}
+	b.mu.Lock()
+	b.regex = regex
+	b.direction = direction
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *ProxyBreakpoints) clear() {
+	b.mu.Lock()
+	b.regex = nil
+	b.mu.Unlock()
+}
+
+func (b *ProxyBreakpoints) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.regex == nil {
+		return "no breakpoint"
+	}
+	return fmt.Sprintf("break on frames from %s matching %s", b.direction, b.regex)
+}
+
+func (b *ProxyBreakpoints) matches(fromClient bool, messageType int, payload []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.regex == nil || (messageType != websocket.TextMessage && messageType != websocket.BinaryMessage) {
+		return false
+	}
+	if (b.direction == BreakOnClient && !fromClient) || (b.direction == BreakOnServer && fromClient) {
+		return false
+	}
+	return b.regex.Match(payload)
+}
+
+// hold blocks until the frame is released if it matches the breakpoint, and returns the payload
+// to forward, or false if the frame is dropped. Held frames are dropped when closing is closed.
+func (b *ProxyBreakpoints) hold(connId uint64, fromClient bool, messageType int, payload []byte, closing chan struct{}) ([]byte, bool) {
+	if !b.matches(fromClient, messageType, payload) {
+		return payload, true
+	}
+
+	b.mu.Lock()
+	b.nextId++
+	frame := &HeldFrame{id: b.nextId, connId: connId, fromClient: fromClient, messageType: messageType, payload: payload, decision: make(chan heldDecision, 1)}
+	b.held = append(b.held, frame)
+	b.mu.Unlock()
+	wsdogLogger.Okf("Held %s (/forward, /edit or /drop %d)", frame, frame.id)
+
+	select {
+	case decision := <-frame.decision:
+		if decision.payload != nil {
+			payload = decision.payload
+		}
+		return payload, decision.forward
+	case <-closing:
+		b.release(frame.id)
+		wsdogLogger.Okf("Dropped held frame #%d as connection %d is closed", frame.id, connId)
+		return nil, false
+	}
+}
+
+// release removes the held frame with the ID, or the earliest held frame if id is 0.
+func (b *ProxyBreakpoints) release(id uint64) (*HeldFrame, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, ok := b.indexOf(id)
+	if !ok {
+		return nil, false
+	}
+	frame := b.held[i]
+	b.held = append(b.held[:i], b.held[i+1:]...)
+	return frame, true
+}
+
+// releaseEdited removes the held frame like release, and returns the edited payload for it, which
+// is decoded from Base64 if the frame is a Binary Message. The frame stays held if the edited
+// payload is invalid.
+func (b *ProxyBreakpoints) releaseEdited(id uint64, edited string) (*HeldFrame, []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, ok := b.indexOf(id)
+	if !ok {
+		return nil, nil, errors.New("no such frame held")
+	}
+	frame := b.held[i]
+	payload := []byte(edited)
+	if frame.messageType == websocket.BinaryMessage {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(edited); err != nil {
+			return nil, nil, fmt.Errorf("invalid string in Base64: \"%s\"", edited)
+		}
+	}
+	b.held = append(b.held[:i], b.held[i+1:]...)
+	return frame, payload, nil
+}
+
+// indexOf returns the index of the held frame with the ID, or of the earliest held frame if id is 0.
+// It must be called with mu locked.
+func (b *ProxyBreakpoints) indexOf(id uint64) (int, bool) {
+	for i, frame := range b.held {
+		if id == 0 || frame.id == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (b *ProxyBreakpoints) list() []*HeldFrame {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*HeldFrame(nil), b.held...)
+}
+
+// ProxyConns keeps all the alive connections in proxy mode by the IDs of their clients.
+type ProxyConns struct {
+	mu    sync.Mutex
+	conns map[uint64]*ProxyConn
+}
+
+func NewProxyConns() *ProxyConns {
+	return &ProxyConns{conns: make(map[uint64]*ProxyConn)}
+}
+
+func (r *ProxyConns) add(p *ProxyConn) {
+	r.mu.Lock()
+	r.conns[p.client.id] = p
+	r.mu.Unlock()
+}
+
+func (r *ProxyConns) remove(p *ProxyConn) {
+	r.mu.Lock()
+	delete(r.conns, p.client.id)
+	r.mu.Unlock()
+}
+
+func (r *ProxyConns) get(id uint64) (*ProxyConn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.conns[id]
+	return p, ok
+}
+
+// ProxyConsole executes the slash commands which only make sense in proxy mode.
+type ProxyConsole struct {
+	conns       *ProxyConns
+	breakpoints *ProxyBreakpoints
+}
+
+func (c *ProxyConsole) findConn(idStr string) (*ProxyConn, bool) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		wsdogLogger.Errorf("invalid connection id: \"%s\"", idStr)
+		return nil, false
+	}
+	p, ok := c.conns.get(id)
+	if !ok {
+		wsdogLogger.Errorf("connection %d not found", id)
+		return nil, false
+	}
+	return p, true
+}
+
+// inject writes a Text Message to the client or the upstream server of a connection, as if it was
+// sent by the other side.
+func (c *ProxyConsole) inject(parameter string, toClient bool) {
+	toks := strings.SplitN(parameter, " ", 2)
+	if len(toks) < 2 {
+		if toClient {
+			wsdogLogger.Error("usage: /to-client <id> message")
+		} else {
+			wsdogLogger.Error("usage: /to-server <id> message")
+		}
+		return
+	}
+	p, ok := c.findConn(toks[0])
+	if !ok {
+		return
+	}
+
+	payload := []byte(toks[1])
+	if toClient {
+		if err := p.client.writeUnreported(websocket.TextMessage, payload); err != nil {
+			wsdogLogger.Errorf("write to client %d failed: %s", p.client.id, err)
+			return
+		}
+	} else if err := p.writeUpstream(websocket.TextMessage, payload); err != nil {
+		wsdogLogger.Errorf("write to server of client %d failed: %s", p.client.id, err)
+		return
+	}
+	wsdogEvents.Injected(p.client.id, toClient, websocket.TextMessage, payload)
+}
+
+// setBreakpoint handles "/break [client|server] <regex>", "/break off" and "/break".
+func (c *ProxyConsole) setBreakpoint(parameter string) {
+	parameter = strings.TrimSpace(parameter)
+	switch parameter {
+	case "":
+		wsdogLogger.Ok(c.breakpoints.String())
+		return
+	case "off":
+		c.breakpoints.clear()
+		if held := len(c.breakpoints.list()); held > 0 {
+			wsdogLogger.Okf("Breakpoint cleared, %d held frame(s) still waiting", held)
+		} else {
+			wsdogLogger.Ok("Breakpoint cleared")
+		}
+		return
+	}
+
+	direction := BreakOnBoth
+	toks := strings.SplitN(parameter, " ", 2)
+	if len(toks) == 2 && (toks[0] == BreakOnClient || toks[0] == BreakOnServer || toks[0] == BreakOnBoth) {
+		direction = toks[0]
+		parameter = toks[1]
+	}
+	if err := c.breakpoints.set(parameter, direction); err != nil {
+		wsdogLogger.Error(err)
+		return
+	}
+	wsdogLogger.Ok(c.breakpoints.String())
+}
+
+func (c *ProxyConsole) listHeld() {
+	held := c.breakpoints.list()
+	if len(held) == 0 {
+		wsdogLogger.Ok("no frame held")
+		return
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].id < held[j].id })
+	for _, frame := range held {
+		wsdogLogger.Okf("%s", frame)
+	}
+}
+
+func parseHeldFrameId(idStr string) (uint64, bool) {
+	if len(idStr) == 0 {
+		return 0, true
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(idStr, "#"), 10, 64)
+	if err != nil {
+		wsdogLogger.Errorf("invalid held frame id: \"%s\"", idStr)
+		return 0, false
+	}
+	return id, true
+}
+
+// release forwards or drops the held frame given by the parameter, or the earliest held frame if
+// the parameter is empty.
+func (c *ProxyConsole) release(parameter string, forward bool) {
+	id, ok := parseHeldFrameId(strings.TrimSpace(parameter))
+	if !ok {
+		return
+	}
+	frame, ok := c.breakpoints.release(id)
+	if !ok {
+		wsdogLogger.Error("no such frame held")
+		return
+	}
+	frame.decision <- heldDecision{forward: forward}
+	if forward {
+		wsdogLogger.Okf("Forwarded #%d", frame.id)
+	} else {
+		wsdogLogger.Okf("Dropped #%d", frame.id)
+	}
+}
+
+// edit forwards a held frame with a new payload, in Base64 for Binary Messages.
+func (c *ProxyConsole) edit(parameter string) {
+	toks := strings.SplitN(parameter, " ", 2)
+	if len(toks) < 2 {
+		wsdogLogger.Error("usage: /edit <held frame id> payload")
+		return
+	}
+	id, ok := parseHeldFrameId(toks[0])
+	if !ok {
+		return
+	}
+
+	frame, payload, err := c.breakpoints.releaseEdited(id, toks[1])
+	if err != nil {
+		wsdogLogger.Error(err)
+		return
+	}
+	wsdogLogger.Okf("Forwarded #%d edited", frame.id)
+	frame.decision <- heldDecision{forward: true, payload: payload}
+}
+
+// execute returns false if the command is not one of the proxy mode.
+func (c *ProxyConsole) execute(cmd *ConsoleCommand) bool {
+	switch cmd.command {
+	case ToClientCommand:
+		c.inject(cmd.parameter, true)
+	case ToServerCommand:
+		c.inject(cmd.parameter, false)
+	case BreakCommand:
+		c.setBreakpoint(cmd.parameter)
+	case HeldCommand:
+		c.listHeld()
+	case ForwardCommand:
+		c.release(cmd.parameter, true)
+	case DropCommand:
+		c.release(cmd.parameter, false)
+	case EditCommand:
+		c.edit(cmd.parameter)
+	default:
+		return false
+	}
+	return true
+}
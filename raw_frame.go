@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RawFrame is a frame written to the connection as is, bypassing every check of the websocket
+// library, so invalid frames like oversized or fragmented control frames can be sent on purpose.
+type RawFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	payload []byte
+}
+
+var frameOpcodes = map[string]byte{
+	"continuation": 0x0,
+	"text":         websocket.TextMessage,
+	"binary":       websocket.BinaryMessage,
+	"close":        websocket.CloseMessage,
+	"ping":         websocket.PingMessage,
+	"pong":         websocket.PongMessage,
+}
+
+// ParseRawFrame parses the parameter of the /frame command, which is like "[nofin] [rsv1] [rsv2] [rsv3]
+// <opcode> [payload in hex]". opcode is a number from 0 to 15 or a name like ping.
+func ParseRawFrame(input string) (*RawFrame, error) {
+	frame := RawFrame{fin: true}
+	toks := strings.Fields(input)
+	for len(toks) > 0 && frame.applyFlag(toks[0]) {
+		toks = toks[1:]
+	}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("opcode is required in \"%s\"", input)
+	}
+	if opcode, ok := frameOpcodes[toks[0]]; ok {
+		frame.opcode = opcode
+	} else if n, err := strconv.ParseUint(toks[0], 0, 8); err == nil && n <= 0xf {
+		frame.opcode = byte(n)
+	} else {
+		return nil, fmt.Errorf("invalid opcode: \"%s\"", toks[0])
+	}
+
+	payload, err := parseHexInput(strings.Join(toks[1:], ""))
+	if err != nil {
+		return nil, err
+	}
+	frame.payload = payload
+	return &frame, nil
+}
+
+func (f *RawFrame) applyFlag(flag string) bool {
+	switch flag {
+	case "nofin":
+		f.fin = false
+	case "rsv1":
+		f.rsv |= 0x40
+	case "rsv2":
+		f.rsv |= 0x20
+	case "rsv3":
+		f.rsv |= 0x10
+	default:
+		return false
+	}
+	return true
+}
+
+// encode returns the frame on the wire, see RFC 6455 section 5.2. Frames from clients must be masked.
+func (f *RawFrame) encode(mask bool) []byte {
+	b0 := f.rsv | f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+
+	length := len(f.payload)
+	switch {
+	case length <= 125:
+		frame[1] = byte(length)
+	case length <= 0xffff:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame[1] = 127
+		frame = append(frame, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	if !mask {
+		return append(frame, f.payload...)
+	}
+	frame[1] |= 0x80
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	frame = append(frame, key...)
+	for i, b := range f.payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+func (f *RawFrame) String() string {
+	return fmt.Sprintf("%s frame (fin: %t, rsv: %03b, %d bytes)", opcodeName(int(f.opcode)), f.fin, f.rsv>>4, len(f.payload))
+}
+
+// writeRawFrame writes the frame to the underlying connection under writeMu, the lock held by the
+// normal writes of messages. A message can be written in several frames, and the raw frame must not
+// get between them.
+func writeRawFrame(conn *websocket.Conn, writeMu *sync.Mutex, connId uint64, frame *RawFrame, mask bool) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	netConn := conn.UnderlyingConn()
+	if err := netConn.SetWriteDeadline(time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		return err
+	}
+	if _, err := netConn.Write(frame.encode(mask)); err != nil {
+		return err
+	}
+	wsdogEvents.Sent(connId, int(frame.opcode), frame.payload)
+	return nil
+}
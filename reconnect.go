@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"time"
+)
+
+// backoff computes exponential delays with jitter between reconnect attempts.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt int
+	random  *rand.Rand
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = defaultReconnectBackoff
+	}
+	if max < initial {
+		max = initial
+	}
+	return &backoff{initial: initial, max: max, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// next returns the delay before the next attempt. Half of the delay is fixed and the other half
+// is random so many clients dropped at the same time do not reconnect all at once.
+func (b *backoff) next() time.Duration {
+	delay := b.initial << uint(b.attempt)
+	if delay <= 0 || delay > b.max {
+		delay = b.max
+	} else {
+		b.attempt++
+	}
+	half := delay / 2
+	return half + time.Duration(b.random.Int63n(int64(half)+1))
+}
+
+// reconnect keeps redialing with the same dialer and headers until it succeeds, the max attempts
+// is reached or the user interrupts. It returns false when the client should stop. The backoff starts
+// over from --reconnect-backoff each time the connection is dropped.
+func (client *Client) reconnect(interrupt chan os.Signal) bool {
+	client.close()
+
+	maxAttempts := client.cliOpts.ReconnectMaxAttempts
+	b := newBackoff(client.cliOpts.ReconnectBackoff, client.cliOpts.ReconnectMaxBackoff)
+	for attempt := 1; maxAttempts <= 0 || attempt <= maxAttempts; attempt++ {
+		delay := b.next()
+		if maxAttempts > 0 {
+			wsdogLogger.Okf("Reconnecting in %s (attempt %d/%d)", delay.Round(time.Millisecond), attempt, maxAttempts)
+		} else {
+			wsdogLogger.Okf("Reconnecting in %s (attempt %d)", delay.Round(time.Millisecond), attempt)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-interrupt:
+			timer.Stop()
+			return false
+		}
+
+		if err := client.connect(); err != nil {
+			wsdogLogger.Errorf("reconnect failed: %s", err)
+			continue
+		}
+		wsdogLogger.Ok("Reconnected (press CTRL+C to quit)")
+		return true
+	}
+
+	wsdogLogger.Errorf("give up reconnecting after %d attempts", maxAttempts)
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// MultiEventSink dispatches every event to all of its sinks in order.
+type MultiEventSink []EventSink
+
+func (m MultiEventSink) Connected(connId uint64, remoteAddr string) {
+	for _, s := range m {
+		s.Connected(connId, remoteAddr)
+	}
+}
+
+func (m MultiEventSink) Disconnected(connId uint64, code int, reason string) {
+	for _, s := range m {
+		s.Disconnected(connId, code, reason)
+	}
+}
+
+func (m MultiEventSink) Received(connId uint64, messageType int, payload []byte) {
+	for _, s := range m {
+		s.Received(connId, messageType, payload)
+	}
+}
+
+func (m MultiEventSink) Sent(connId uint64, messageType int, payload []byte) {
+	for _, s := range m {
+		s.Sent(connId, messageType, payload)
+	}
+}
+
+func (m MultiEventSink) Injected(connId uint64, toClient bool, messageType int, payload []byte) {
+	for _, s := range m {
+		s.Injected(connId, toClient, messageType, payload)
+	}
+}
+
+// RecordedEvent is a line in the file written by --record. Elapsed is the milliseconds
+// passed since its connection was established.
+type RecordedEvent struct {
+	JsonLinesEvent
+	Elapsed float64 `json:"elapsed"`
+}
+
+// SessionRecorder writes every event to a file given by --record, so the session can be
+// replayed by --replay later. The file is not buffered so nothing is lost when wsdog exits.
+type SessionRecorder struct {
+	mu          sync.Mutex
+	file        *os.File
+	encoder     *json.Encoder
+	connectedAt map[uint64]time.Time
+}
+
+func NewSessionRecorder(path string) (*SessionRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create record file \"%s\" failed: %s", path, err)
+	}
+	return &SessionRecorder{file: file, encoder: json.NewEncoder(file), connectedAt: make(map[uint64]time.Time)}, nil
+}
+
+func (r *SessionRecorder) write(connId uint64, event *JsonLinesEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	event.Time = now.Format(time.RFC3339Nano)
+	if event.Event == "connect" {
+		r.connectedAt[connId] = now
+	}
+	elapsed := 0.0
+	if connectedAt, ok := r.connectedAt[connId]; ok {
+		elapsed = float64(now.Sub(connectedAt).Microseconds()) / 1000
+	}
+	if event.Event == "disconnect" {
+		delete(r.connectedAt, connId)
+	}
+
+	if err := r.encoder.Encode(&RecordedEvent{*event, elapsed}); err != nil {
+		wsdogLogger.Errorf("write record file failed: %s", err)
+	}
+}
+
+func (r *SessionRecorder) Connected(connId uint64, remoteAddr string) {
+	r.write(connId, &JsonLinesEvent{Event: "connect", ConnId: connId, RemoteAddr: remoteAddr})
+}
+
+func (r *SessionRecorder) Disconnected(connId uint64, code int, reason string) {
+	r.write(connId, &JsonLinesEvent{Event: "disconnect", ConnId: connId, Code: code, Reason: reason})
+}
+
+func (r *SessionRecorder) Received(connId uint64, messageType int, payload []byte) {
+	r.write(connId, newFrameEvent(connId, "in", messageType, payload))
+}
+
+func (r *SessionRecorder) Sent(connId uint64, messageType int, payload []byte) {
+	r.write(connId, newFrameEvent(connId, "out", messageType, payload))
+}
+
+func (r *SessionRecorder) Injected(connId uint64, toClient bool, messageType int, payload []byte) {
+	r.write(connId, newInjectedFrameEvent(connId, toClient, messageType, payload))
+}
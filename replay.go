@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// ReplayFrame is a frame of the recorded session to replay.
+type ReplayFrame struct {
+	elapsed     time.Duration
+	messageType int
+	payload     []byte
+}
+
+func opcodeFromName(name string) (int, bool) {
+	switch name {
+	case "text":
+		return websocket.TextMessage, true
+	case "binary":
+		return websocket.BinaryMessage, true
+	case "ping":
+		return websocket.PingMessage, true
+	case "pong":
+		return websocket.PongMessage, true
+	case "close":
+		return websocket.CloseMessage, true
+	}
+	return 0, false
+}
+
+func decodeRecordedFrame(event *RecordedEvent) (*ReplayFrame, error) {
+	messageType, ok := opcodeFromName(event.Opcode)
+	if !ok {
+		return nil, fmt.Errorf("unknown opcode: \"%s\"", event.Opcode)
+	}
+
+	payload := []byte(event.Payload)
+	if event.Encoding == "base64" {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(event.Payload); err != nil {
+			return nil, fmt.Errorf("invalid string in Base64: \"%s\"", event.Payload)
+		}
+	}
+	// a close frame recorded without a status code has code 0, which can't be sent, so it's
+	// replayed with an empty payload
+	if messageType == websocket.CloseMessage && event.Code != 0 {
+		payload = websocket.FormatCloseMessage(event.Code, string(payload))
+	}
+	return &ReplayFrame{time.Duration(event.Elapsed * float64(time.Millisecond)), messageType, payload}, nil
+}
+
+// LoadRecordedSession returns the outbound frames and the inbound Text and Binary frames of
+// the first connection in a file written by --record.
+func LoadRecordedSession(path string) ([]*ReplayFrame, []*ReplayFrame, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open replay file \"%s\" failed: %s", path, err)
+	}
+	defer file.Close()
+
+	var outbound, inbound []*ReplayFrame
+	var connId *uint64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLineSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event RecordedEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return nil, nil, fmt.Errorf("parse line %d of \"%s\" failed: %s", lineNo, path, err)
+		}
+		if event.Event != "frame" {
+			continue
+		}
+		if connId == nil {
+			connId = &event.ConnId
+		} else if *connId != event.ConnId {
+			continue
+		}
+
+		frame, err := decodeRecordedFrame(&event)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid line %d of \"%s\": %s", lineNo, path, err)
+		}
+		if event.Direction == "out" {
+			// pongs are replied automatically to pings, and keepalive pings are sent by --ping-interval
+			// of the replaying client, so neither is replayed
+			keepalive := frame.messageType == websocket.PingMessage && bytes.HasPrefix(frame.payload, []byte(keepalivePingPrefix))
+			if frame.messageType != websocket.PongMessage && !keepalive {
+				outbound = append(outbound, frame)
+			}
+		} else if frame.messageType == websocket.TextMessage || frame.messageType == websocket.BinaryMessage {
+			inbound = append(inbound, frame)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("read replay file \"%s\" failed: %s", path, err)
+	}
+	return outbound, inbound, nil
+}
+
+func describeFrame(messageType int, payload []byte) string {
+	if messageType == websocket.BinaryMessage {
+		return fmt.Sprintf("binary \"%s\"", base64.StdEncoding.EncodeToString(payload))
+	}
+	return fmt.Sprintf("%s \"%s\"", opcodeName(messageType), payload)
+}
+
+// reportReplayDifferences compares received Text and Binary frames with the recorded ones in order
+// and returns whether they are the same.
+func reportReplayDifferences(expected []*ReplayFrame, received []*WebSocketMessage) bool {
+	same := true
+	for i := 0; i < len(expected) || i < len(received); i++ {
+		switch {
+		case i >= len(received):
+			wsdogLogger.Errorf("response #%d missing: expect %s", i+1, describeFrame(expected[i].messageType, expected[i].payload))
+			same = false
+		case i >= len(expected):
+			wsdogLogger.Errorf("response #%d unexpected: got %s", i+1, describeFrame(received[i].messageType, received[i].payload))
+			same = false
+		case expected[i].messageType != received[i].messageType || !bytes.Equal(expected[i].payload, received[i].payload):
+			wsdogLogger.Errorf("response #%d differs: expect %s, got %s", i+1,
+				describeFrame(expected[i].messageType, expected[i].payload),
+				describeFrame(received[i].messageType, received[i].payload))
+			same = false
+		}
+	}
+	return same
+}
+
+// runReplay sends the recorded outbound frames with their original timing scaled by --replay-speed,
+// or as fast as possible if the speed is 0. Then it reports where the responses differ from the recording.
+func (client *Client) runReplay(cliOpts CommandLineOptions) int {
+	outbound, inbound, err := LoadRecordedSession(cliOpts.Replay)
+	if err != nil {
+		wsdogLogger.Fatal(err)
+	}
+	if cliOpts.ReplaySpeed < 0 {
+		wsdogLogger.Fatalf("invalid replay speed: %v", cliOpts.ReplaySpeed)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	var received []*WebSocketMessage
+	collect := func(message *WebSocketMessage) bool {
+		if message.messageType == websocket.TextMessage || message.messageType == websocket.BinaryMessage {
+			received = append(received, &WebSocketMessage{message.messageType, message.payload, nil})
+		}
+		return len(received) >= len(inbound)
+	}
+	neverSatisfied := func(message *WebSocketMessage) bool {
+		collect(message)
+		return false
+	}
+
+	start := time.Now()
+	closed := false
+	var closeFrame *ReplayFrame
+	for i, frame := range outbound {
+		// the close frame is held until all the responses are received, or the server
+		// may drop them when the frames are replayed faster than recorded
+		if frame.messageType == websocket.CloseMessage {
+			closeFrame = frame
+			break
+		}
+
+		if cliOpts.ReplaySpeed > 0 {
+			deadline := start.Add(time.Duration(float64(frame.elapsed) / cliOpts.ReplaySpeed))
+			switch client.receiveUntil(deadline, interrupt, neverSatisfied) {
+			case waitClosed:
+				wsdogLogger.Errorf("connection closed before replaying frame #%d", i+1)
+				closed = true
+			case waitInterrupted:
+				return ExitError
+			}
+		}
+		if closed {
+			break
+		}
+
+		if err := client.tryWriteMessage(frame.messageType, frame.payload); err != nil {
+			wsdogLogger.Errorf("replay frame #%d failed: %s", i+1, err)
+			closed = true
+			break
+		}
+	}
+
+	if !closed && len(received) < len(inbound) {
+		timeout := time.Second * time.Duration(cliOpts.Wait)
+		switch client.receiveUntil(time.Now().Add(timeout), interrupt, collect) {
+		case waitClosed:
+			closed = true
+		case waitInterrupted:
+			return ExitError
+		}
+	}
+
+	if !closed && closeFrame != nil {
+		if err := client.tryWriteMessage(closeFrame.messageType, closeFrame.payload); err != nil {
+			wsdogLogger.Errorf("replay close frame failed: %s", err)
+		}
+		client.close()
+	}
+
+	if !reportReplayDifferences(inbound, received) {
+		return ExitAssertionFailed
+	}
+	wsdogLogger.Okf("Replayed %d frame(s), all %d response(s) are the same as recorded", len(outbound), len(inbound))
+	return ExitOk
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRecordedSession(t *testing.T) {
+	lines := `{"event":"connect","conn":1,"elapsed":0}
+{"event":"frame","conn":1,"direction":"out","opcode":"text","payload":"hi","elapsed":1.5}
+{"event":"frame","conn":1,"direction":"in","opcode":"text","payload":"hi","elapsed":2}
+{"event":"frame","conn":1,"direction":"out","opcode":"ping","payload":"wsdog-keepalive:1634535892923869537","elapsed":3}
+{"event":"frame","conn":1,"direction":"out","opcode":"ping","payload":"are you there","elapsed":4}
+{"event":"frame","conn":1,"direction":"out","opcode":"pong","payload":"x","elapsed":5}
+{"event":"frame","conn":2,"direction":"out","opcode":"text","payload":"other","elapsed":5}
+{"event":"frame","conn":1,"direction":"in","opcode":"binary","payload":"AAEC","encoding":"base64","elapsed":6}
+{"event":"frame","conn":1,"direction":"out","opcode":"close","code":1001,"reason":"bye","payload":"bye","elapsed":7}
+{"event":"frame","conn":1,"direction":"out","opcode":"close","elapsed":8}
+`
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := os.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outbound, inbound, err := LoadRecordedSession(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOutbound := []*ReplayFrame{
+		{1500 * time.Microsecond, websocket.TextMessage, []byte("hi")},
+		{4 * time.Millisecond, websocket.PingMessage, []byte("are you there")},
+		{7 * time.Millisecond, websocket.CloseMessage, websocket.FormatCloseMessage(1001, "bye")},
+		{8 * time.Millisecond, websocket.CloseMessage, nil},
+	}
+	wantInbound := []*ReplayFrame{
+		{2 * time.Millisecond, websocket.TextMessage, []byte("hi")},
+		{6 * time.Millisecond, websocket.BinaryMessage, []byte{0, 1, 2}},
+	}
+	checkReplayFrames(t, "outbound", outbound, wantOutbound)
+	checkReplayFrames(t, "inbound", inbound, wantInbound)
+}
+
+func checkReplayFrames(t *testing.T, name string, got []*ReplayFrame, want []*ReplayFrame) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d frames, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		if got[i].elapsed != want[i].elapsed || got[i].messageType != want[i].messageType || !bytes.Equal(got[i].payload, want[i].payload) {
+			t.Errorf("%s #%d: got %+v, want %+v", name, i+1, *got[i], *want[i])
+		}
+	}
+}
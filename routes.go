@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RouteBehaviour string
+
+const (
+	RoutePrint  RouteBehaviour = "print"
+	RouteEcho                  = "echo"
+	RouteChat                  = "chat"
+	RouteFeed                  = "feed"
+	RouteRules                 = "rules"
+	RouteReject                = "reject"
+	RouteExec                  = "exec"
+)
+
+// Route tells how the server behaves for the connections to a path. It's given by --route like:
+//
+//	/echo=echo
+//	/chat=chat
+//	/feed=feed:messages.jsonl
+//	/stub=rules:rules.yaml
+//	/reject=reject:403
+//	/shell=exec:grep --line-buffered error
+//
+// Received messages are always printed. An echo route writes them back to the sender, and a chat
+// route relays them to the other clients in the same room, which is the route unless --room-by is
+// set. A feed route sends the messages in a file of the format of --input-file to each client, and
+// a rules route replies according to a file of the format of --rules. A reject route rejects the
+// upgrade request with the status, 403 by default. An exec route starts the command for each client
+// like --exec.
+type Route struct {
+	path      string
+	behaviour RouteBehaviour
+	echo      bool
+	// hub is set when the route relays messages between clients
+	hub    *ChatHub
+	rules  *MockRules
+	feed   []*BatchStep
+	status int
+	// exec is the command and its arguments started for each connection
+	exec []string
+}
+
+// newDefaultRoute serves every path when no route is declared, with --echo, --broadcast, --rules and --exec.
+func newDefaultRoute(opts CommandLineOptions, rules *MockRules) *Route {
+	route := &Route{path: "/", behaviour: RoutePrint, echo: opts.Echo, rules: rules}
+	if len(opts.Exec) > 0 {
+		if opts.Echo || opts.Broadcast || rules != nil {
+			wsdogLogger.Fatal("--exec can not be used with --echo, --broadcast or --rules")
+		}
+		var err error
+		if route.exec, err = splitCommandLine(opts.Exec); err != nil {
+			wsdogLogger.Fatal(err)
+		}
+		route.behaviour = RouteExec
+	} else if opts.Broadcast {
+		route.behaviour = RouteChat
+	} else if opts.Echo {
+		route.behaviour = RouteEcho
+	}
+	return route
+}
+
+func ParseRoute(spec string, opts CommandLineOptions) (*Route, error) {
+	toks := strings.SplitN(spec, "=", 2)
+	if len(toks) != 2 || !strings.HasPrefix(toks[0], "/") {
+		return nil, fmt.Errorf("invalid route: \"%s\", expect <path>=<behaviour>[:argument] like /echo=echo", spec)
+	}
+
+	route := &Route{path: toks[0]}
+	behaviour := strings.SplitN(toks[1], ":", 2)
+	route.behaviour = RouteBehaviour(behaviour[0])
+	argument := ""
+	if len(behaviour) == 2 {
+		argument = behaviour[1]
+	}
+
+	var err error
+	switch route.behaviour {
+	case RoutePrint:
+	case RouteEcho:
+		route.echo = true
+	case RouteChat:
+	case RouteFeed:
+		if len(argument) == 0 {
+			return nil, fmt.Errorf("invalid route: \"%s\", feed requires a file like feed:messages.jsonl", spec)
+		}
+		if route.feed, err = LoadFeed(argument); err != nil {
+			return nil, err
+		}
+	case RouteRules:
+		if len(argument) == 0 {
+			return nil, fmt.Errorf("invalid route: \"%s\", rules requires a file like rules:rules.yaml", spec)
+		}
+		if route.rules, err = LoadMockRules(argument); err != nil {
+			return nil, err
+		}
+		route.echo = opts.Echo
+	case RouteReject:
+		route.status = http.StatusForbidden
+		if len(argument) > 0 {
+			if route.status, err = strconv.Atoi(argument); err != nil || route.status < 400 || route.status > 599 {
+				return nil, fmt.Errorf("invalid route: \"%s\", status of reject must be from 400 to 599", spec)
+			}
+		}
+	case RouteExec:
+		if len(argument) == 0 {
+			return nil, fmt.Errorf("invalid route: \"%s\", exec requires a command like exec:cat", spec)
+		}
+		if route.exec, err = splitCommandLine(argument); err != nil {
+			return nil, fmt.Errorf("invalid route: \"%s\", %s", spec, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid route: \"%s\", unknown behaviour \"%s\"", spec, route.behaviour)
+	}
+	return route, nil
+}
+
+// LoadFeed loads the messages sent by a feed route from a file of the format of --input-file.
+func LoadFeed(path string) ([]*BatchStep, error) {
+	steps, err := LoadBatchSteps(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, step := range steps {
+		if step.Wait != nil {
+			return nil, fmt.Errorf("invalid line %d of \"%s\": wait is not supported in a feed", i+1, path)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no message to feed in \"%s\"", path)
+	}
+	return steps, nil
+}
+
+// runFeed sends the messages of the feed to the client one by one, until the connection is closed.
+func (route *Route) runFeed(c *ServerConn, done chan struct{}) {
+	for _, step := range route.feed {
+		timer := time.NewTimer(step.Delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		var err error
+		switch step.Type {
+		case BatchClose:
+			err = c.closeGracefully(step.Code, step.Data)
+		case BatchPing:
+			err = c.writeControl(step.messageType(), step.payload)
+		default:
+			err = c.writeMessage(step.messageType(), step.payload)
+		}
+		if err != nil {
+			wsdogLogger.Errorf("feed to client %d on %s failed: %s", c.id, c.path, err)
+			return
+		}
+		if step.Type == BatchClose {
+			return
+		}
+	}
+}
+
+func (route *Route) reject(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(route.status), route.status)
+	wsdogLogger.Okf("Rejected request to %s from %s with %d %s", r.URL.Path, r.RemoteAddr, route.status, http.StatusText(route.status))
+}
+
+func (route *Route) String() string {
+	if route.status > 0 {
+		return fmt.Sprintf("%s (%s %d)", route.path, route.behaviour, route.status)
+	}
+	return fmt.Sprintf("%s (%s)", route.path, route.behaviour)
+}
+
+// Router dispatches requests to the handlers of the routes by exact path, and responds 404 to unknown paths.
+type Router struct {
+	handlers map[string]http.HandlerFunc
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, ok := router.handlers[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		wsdogLogger.Okf("Rejected request to unknown path %s from %s with 404", r.URL.Path, r.RemoteAddr)
+		return
+	}
+	handler(w, r)
+}
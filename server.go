@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 func closeConn(conn *websocket.Conn) {
@@ -12,31 +16,146 @@ func closeConn(conn *websocket.Conn) {
 	}
 }
 
-func generateWsHandler(opts CommandLineOptions) func(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{Subprotocols: []string{opts.Subprotocol}, HandshakeTimeout: defaultHandshakeTimeout}
+func generateWsHandler(opts CommandLineOptions, registry *ServerConnRegistry, route *Route) func(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{Subprotocols: subprotocolList(opts), HandshakeTimeout: defaultHandshakeTimeout, EnableCompression: opts.Compression}
+	rules := route.rules
 	return func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		if route.status > 0 {
+			route.reject(w, r)
+			return
+		}
+		recorder := &handshakeRecorder{ResponseWriter: w}
+		if opts.VerboseHandshake {
+			wsdogLogger.Okf("Upgrade request to %s from %s", r.URL.Path, r.RemoteAddr)
+			printHandshakeRequest("< ", r)
+		}
+		if opts.StrictSubprotocol && len(upgrader.Subprotocols) > 0 && len(selectSubprotocol(upgrader.Subprotocols, r)) == 0 {
+			http.Error(recorder, "no supported subprotocol", http.StatusBadRequest)
+			if opts.VerboseHandshake {
+				recorder.printResponse(r)
+			}
+			if requested := requestedSubprotocols(r.Header); len(requested) > 0 {
+				wsdogLogger.Errorf("websocket upgrade failed: none of the requested subprotocols %s is supported", strings.Join(requested, ", "))
+			} else {
+				wsdogLogger.Errorf("websocket upgrade failed: client requested no subprotocol")
+			}
+			return
+		}
+		conn, err := upgrader.Upgrade(recorder, r, nil)
 		if err != nil {
+			if opts.VerboseHandshake && recorder.status > 0 {
+				recorder.printResponse(r)
+			}
 			wsdogLogger.Errorf("websocket upgrade failed: %s", err.Error())
 			return
 		}
+		if opts.VerboseHandshake {
+			if resp, err := recorder.upgradeResponse(r); err != nil {
+				wsdogLogger.Debugf("parse upgrade response failed: %s", err)
+			} else {
+				printUpgradeResponse(resp)
+			}
+		}
 
-		wsdogLogger.Ok("Client connected")
+		serverConn := registry.add(conn, r.URL.Path)
+		wsdogLogger.Okf("Client %d connected to %s (from %s)", serverConn.id, serverConn.path, conn.RemoteAddr())
+		wsdogEvents.Connected(serverConn.id, conn.RemoteAddr().String())
+		if len(upgrader.Subprotocols) > 0 && len(conn.Subprotocol()) > 0 {
+			wsdogLogger.Okf("Client %d uses subprotocol %s", serverConn.id, conn.Subprotocol())
+		}
+		if opts.Compression {
+			if resp, err := recorder.upgradeResponse(r); err == nil && hasPermessageDeflate(resp.Header) {
+				wsdogLogger.Okf("Client %d negotiated permessage-deflate", serverConn.id)
+			} else {
+				wsdogLogger.Okf("Client %d does not support compression", serverConn.id)
+			}
+			if err := conn.SetCompressionLevel(opts.CompressionLevel); err != nil {
+				wsdogLogger.Errorf("set compression level of client %d failed: %s", serverConn.id, err)
+				registry.remove(serverConn)
+				closeConn(conn)
+				return
+			}
+			if sniffer, ok := frameSnifferOf(conn); ok {
+				sniffer.beginFrames()
+			}
+		}
 
-		readWsChan, _ := SetupReadFromConn(conn, opts.ShowPingPong)
-		defer closeConn(conn)
+		readWsChan, readWsDoneChan := SetupReadFromConn(conn, serverConn.id, opts.ShowPingPong, newKeepalive(opts.PingInterval, opts.PongTimeout), nil)
+		pushDone := make(chan struct{})
+		if rules != nil {
+			rules.RunPushes(serverConn, pushDone)
+		}
+		if len(route.feed) > 0 {
+			go route.runFeed(serverConn, pushDone)
+		}
+		if route.hub != nil {
+			route.hub.join(serverConn, roomOf(route, r, opts.RoomBy))
+		}
+		var process *ExecProcess
+		var processExited chan struct{}
+		if len(route.exec) > 0 {
+			if process, err = startExecProcess(route.exec, serverConn, r); err != nil {
+				wsdogLogger.Errorf("start \"%s\" for client %d failed: %s", strings.Join(route.exec, " "), serverConn.id, err)
+				message := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to start process")
+				if err := serverConn.writeControl(websocket.CloseMessage, message); err != nil {
+					wsdogLogger.Debugf("write close frame to connection %d failed: %s", serverConn.id, err)
+				}
+			} else {
+				wsdogLogger.Okf("Started process %d for client %d", process.cmd.Process.Pid, serverConn.id)
+				processExited = process.exited
+			}
+		}
+		defer func() {
+			if process != nil {
+				process.terminate()
+			}
+			if route.hub != nil {
+				route.hub.leave(serverConn)
+			}
+			close(pushDone)
+			registry.remove(serverConn)
+			close(readWsDoneChan)
+			closeConn(conn)
+			wsdogLogger.Okf("Client %d left %s", serverConn.id, serverConn.path)
+		}()
+		if len(route.exec) > 0 && process == nil {
+			return
+		}
 		for {
 			select {
 			//case <-readFromConnDone:
 			//	return
+			case <-processExited:
+				code, reason := process.describeExit(opts.ExecCloseCode, opts.ExecErrorCloseCode)
+				wsdogLogger.Okf("Process %d of client %d exited, closing with code %d (%s)", process.cmd.Process.Pid, serverConn.id, code, reason)
+				if err := serverConn.writeControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)); err != nil {
+					wsdogLogger.Debugf("write close frame to connection %d failed: %s", serverConn.id, err)
+				}
+				return
 			case message, ok := <-readWsChan:
 				if !ok {
 					return
 				}
-				PrintReceivedMessage(&message)
+				PrintReceivedMessageFromConn(serverConn.id, &message)
 
-				if opts.Echo {
-					err = conn.WriteMessage(message.messageType, message.payload)
+				if process != nil {
+					if message.messageType != websocket.TextMessage {
+						wsdogLogger.Errorf("binary message from client %d is not written to the process", serverConn.id)
+					} else if err := process.writeLine(message.payload); err != nil {
+						wsdogLogger.Error(err)
+					}
+					continue
+				}
+
+				if rules != nil && rules.Reply(serverConn, &message, pushDone) {
+					continue
+				}
+
+				if route.hub != nil {
+					route.hub.relay(serverConn, &message)
+				}
+				if route.echo {
+					err = serverConn.writeMessage(message.messageType, message.payload)
 					if err != nil {
 						wsdogLogger.Errorf("error: %s", err)
 						return
@@ -47,9 +166,128 @@ func generateWsHandler(opts CommandLineOptions) func(w http.ResponseWriter, r *h
 	}
 }
 
+// metricsPathShadows tells if requests to the path would be served by the metrics handler, which
+// is registered along with the handler of "/". A metrics path ending with / matches the whole subtree.
+func metricsPathShadows(metricsPath string, path string) bool {
+	return path == metricsPath || strings.HasSuffix(metricsPath, "/") && strings.HasPrefix(path, metricsPath)
+}
+
 func RunAsServer(listenPort uint16, opts CommandLineOptions) {
-	http.HandleFunc("/", generateWsHandler(opts))
+	tlsConfig, err := newServerTlsConfig(opts)
+	if err != nil {
+		wsdogLogger.Fatalf("setup TLS failed: %s", err)
+	}
 
-	wsdogLogger.Okf("Listening on port %d (press CTRL+C to quit)", listenPort)
-	wsdogLogger.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", opts.ListenHost, listenPort), nil))
+	if len(opts.Rules) > 0 && len(opts.Routes) > 0 {
+		wsdogLogger.Fatal("--rules can not be used with --route, declare a route like /path=rules:<file> instead")
+	}
+	if len(opts.Exec) > 0 && len(opts.Routes) > 0 {
+		wsdogLogger.Fatal("--exec can not be used with --route, declare a route like /path=exec:<command> instead")
+	}
+
+	var rules *MockRules
+	if len(opts.Rules) > 0 {
+		if rules, err = LoadMockRules(opts.Rules); err != nil {
+			wsdogLogger.Fatal(err)
+		}
+	}
+
+	if len(opts.MetricsPath) > 0 && !strings.HasPrefix(opts.MetricsPath, "/") {
+		wsdogLogger.Fatalf("invalid metrics path: \"%s\", it must start with /", opts.MetricsPath)
+	}
+	if opts.MetricsPath == "/" {
+		wsdogLogger.Fatal("invalid metrics path: \"/\", it's where WebSocket connections are accepted")
+	}
+
+	stats := NewServerStats()
+	SetEventSink(MultiEventSink{wsdogEvents, stats})
+
+	registry := serverConns
+	hub := NewChatHub()
+	var proxyConsole *ProxyConsole
+	if len(opts.Proxy) > 0 {
+		if len(opts.Routes) > 0 || opts.Broadcast || opts.Echo || rules != nil || len(opts.Exec) > 0 {
+			wsdogLogger.Fatal("--proxy can not be used with --route, --broadcast, --echo, --rules or --exec")
+		}
+		proxyConsole = &ProxyConsole{conns: NewProxyConns(), breakpoints: &ProxyBreakpoints{}}
+		if len(opts.Break) > 0 {
+			if !isConsoleAvailable() {
+				wsdogLogger.Fatal("--break requires a console to release the held frames")
+			}
+			if err := proxyConsole.breakpoints.set(opts.Break, opts.BreakOn); err != nil {
+				wsdogLogger.Fatal(err)
+			}
+		}
+		upstream := parseConnectUrl(opts.Proxy)
+		http.HandleFunc("/", generateProxyHandler(opts, registry, proxyConsole.conns, proxyConsole.breakpoints, upstream))
+		wsdogLogger.Okf("Relaying connections to %s", upstream)
+		if len(opts.Break) > 0 {
+			wsdogLogger.Ok(proxyConsole.breakpoints.String())
+		}
+	} else if len(opts.Break) > 0 {
+		wsdogLogger.Fatal("--break can only be used with --proxy")
+	} else if len(opts.Routes) > 0 {
+		router := &Router{handlers: make(map[string]http.HandlerFunc)}
+		for _, spec := range opts.Routes {
+			route, err := ParseRoute(spec, opts)
+			if err != nil {
+				wsdogLogger.Fatal(err)
+			}
+			if route.behaviour == RouteChat {
+				route.hub = hub
+			}
+			if _, ok := router.handlers[route.path]; ok {
+				wsdogLogger.Fatalf("duplicate route: \"%s\"", route.path)
+			}
+			if len(opts.MetricsPath) > 0 && metricsPathShadows(opts.MetricsPath, route.path) {
+				wsdogLogger.Fatalf("invalid metrics path: \"%s\", it collides with route \"%s\"", opts.MetricsPath, route.path)
+			}
+			router.handlers[route.path] = generateWsHandler(opts, registry, route)
+			wsdogLogger.Okf("Route %s", route)
+		}
+		http.Handle("/", router)
+	} else {
+		route := newDefaultRoute(opts, rules)
+		if opts.Broadcast {
+			route.hub = hub
+		}
+		http.HandleFunc("/", generateWsHandler(opts, registry, route))
+	}
+	if len(opts.MetricsPath) > 0 {
+		http.Handle(opts.MetricsPath, stats)
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf("%s:%d", opts.ListenHost, listenPort), TLSConfig: tlsConfig}
+	serve := func() {
+		if opts.Compression && tlsConfig == nil {
+			wsdogLogger.Fatal(serveSniffingFrames(server))
+		} else if tlsConfig != nil {
+			wsdogLogger.Fatal(server.ListenAndServeTLS("", ""))
+		} else {
+			wsdogLogger.Fatal(server.ListenAndServe())
+		}
+	}
+
+	if tlsConfig != nil && opts.Compression {
+		wsdogLogger.Okf("Sizes of received messages on the wire are not available with TLS")
+	}
+	if tlsConfig != nil {
+		wsdogLogger.Okf("Listening on port %d with TLS (press CTRL+C to quit)", listenPort)
+	} else {
+		wsdogLogger.Okf("Listening on port %d (press CTRL+C to quit)", listenPort)
+	}
+	if len(opts.MetricsPath) > 0 {
+		wsdogLogger.Okf("Serving metrics on %s", opts.MetricsPath)
+	}
+
+	go serve()
+	if isConsoleAvailable() {
+		console := ServerConsole{registry, proxyConsole}
+		console.loop()
+	} else {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		<-interrupt
+	}
+	stats.printSummary()
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"github.com/chzyer/readline"
+	"github.com/fatih/color"
+	"github.com/gorilla/websocket"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ToCommand   CommandType = "to"
+	ListCommand             = "list"
+	KickCommand             = "kick"
+)
+
+// ServerConn is a connection accepted in listen mode.
+type ServerConn struct {
+	id          uint64
+	conn        *websocket.Conn
+	path        string
+	connectedAt time.Time
+	writeMu     sync.Mutex
+}
+
+// writeMessage can be called from both the connection's own handler and the console,
+// so writes are serialized as gorilla/websocket only supports one concurrent writer.
+func (c *ServerConn) writeMessage(messageType int, payload []byte) error {
+	if err := c.writeUnreported(messageType, payload); err != nil {
+		return err
+	}
+	wsdogEvents.Sent(c.id, messageType, payload)
+	return nil
+}
+
+// writeUnreported writes a message like writeMessage, for messages already reported as sent.
+func (c *ServerConn) writeUnreported(messageType int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(messageType, payload)
+}
+
+func (c *ServerConn) writeControl(messageType int, payload []byte) error {
+	if err := c.conn.WriteControl(messageType, payload, time.Now().Add(defaultWriteWaitDuration)); err != nil {
+		return err
+	}
+	wsdogEvents.Sent(c.id, messageType, payload)
+	return nil
+}
+
+// closeGracefully writes a close frame, then drops the connection after defaultWriteWaitDuration,
+// which gives the client a chance to reply the close frame. The connection is dropped at once if the
+// close frame can't be written.
+func (c *ServerConn) closeGracefully(code int, reason string) error {
+	if err := c.writeControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)); err != nil {
+		closeConn(c.conn)
+		return err
+	}
+	time.AfterFunc(defaultWriteWaitDuration, func() { closeConn(c.conn) })
+	return nil
+}
+
+// ServerConnRegistry keeps all the alive connections in listen mode by their IDs.
+type ServerConnRegistry struct {
+	mu     sync.Mutex
+	conns  map[uint64]*ServerConn
+	nextId uint64
+}
+
+func NewServerConnRegistry() *ServerConnRegistry {
+	return &ServerConnRegistry{conns: make(map[uint64]*ServerConn)}
+}
+
+func (r *ServerConnRegistry) add(conn *websocket.Conn, path string) *ServerConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextId++
+	c := &ServerConn{id: r.nextId, conn: conn, path: path, connectedAt: time.Now()}
+	r.conns[c.id] = c
+	return c
+}
+
+func (r *ServerConnRegistry) remove(c *ServerConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+}
+
+func (r *ServerConnRegistry) get(id uint64) (*ServerConn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.conns[id]
+	return c, ok
+}
+
+// list returns alive connections ordered by their IDs.
+func (r *ServerConnRegistry) list() []*ServerConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*ServerConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// serverConns are the alive connections in listen mode, looked up by connPrefix.
+var serverConns = NewServerConnRegistry()
+
+// connPrefix is printed before everything printed for a connection in listen mode, with the ID
+// and the path of the connection. It's empty for the connection of the client.
+func connPrefix(connId uint64) string {
+	if connId == 0 {
+		return ""
+	}
+	if c, ok := serverConns.get(connId); ok {
+		return fmt.Sprintf("[%d %s] ", connId, c.path)
+	}
+	return fmt.Sprintf("[%d] ", connId)
+}
+
+type ServerConsole struct {
+	registry *ServerConnRegistry
+	// proxy executes the commands of proxy mode if it's not nil
+	proxy *ProxyConsole
+}
+
+func (s *ServerConsole) findConn(idStr string) (*ServerConn, bool) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		wsdogLogger.Errorf("invalid connection id: \"%s\"", idStr)
+		return nil, false
+	}
+	c, ok := s.registry.get(id)
+	if !ok {
+		wsdogLogger.Errorf("connection %d not found", id)
+		return nil, false
+	}
+	return c, true
+}
+
+func (s *ServerConsole) broadcast(message string) {
+	conns := s.registry.list()
+	if len(conns) == 0 {
+		wsdogLogger.Error("no client connected")
+		return
+	}
+	for _, c := range conns {
+		if err := c.writeMessage(websocket.TextMessage, []byte(message)); err != nil {
+			wsdogLogger.Errorf("write to connection %d failed: %s", c.id, err)
+		}
+	}
+}
+
+func (s *ServerConsole) sendTo(parameter string) {
+	toks := strings.SplitN(parameter, " ", 2)
+	if len(toks) < 2 {
+		wsdogLogger.Error("usage: /to <id> message")
+		return
+	}
+	c, ok := s.findConn(toks[0])
+	if !ok {
+		return
+	}
+	if err := c.writeMessage(websocket.TextMessage, []byte(toks[1])); err != nil {
+		wsdogLogger.Errorf("write to connection %d failed: %s", c.id, err)
+	}
+}
+
+func (s *ServerConsole) listConns() {
+	conns := s.registry.list()
+	if len(conns) == 0 {
+		wsdogLogger.Ok("no client connected")
+		return
+	}
+	for _, c := range conns {
+		wsdogLogger.Okf("%d\t%s\t%s\tconnected %s ago", c.id, c.conn.RemoteAddr(), c.path, time.Since(c.connectedAt).Round(time.Second))
+	}
+}
+
+func (s *ServerConsole) kick(parameter string) {
+	toks := regexp.MustCompile("\\s+").Split(strings.TrimSpace(parameter), -1)
+	if len(toks[0]) == 0 {
+		wsdogLogger.Error("usage: /kick <id> [code [reason]]")
+		return
+	}
+	c, ok := s.findConn(toks[0])
+	if !ok {
+		return
+	}
+
+	statusCode := defaultCloseStatusCode
+	reason := defaultCloseReason
+	if len(toks) >= 2 {
+		var err error
+		if statusCode, err = strconv.Atoi(toks[1]); err != nil {
+			wsdogLogger.Errorf("invalid close status code: \"%s\"", toks[1])
+			return
+		}
+	}
+	if len(toks) >= 3 {
+		reason = strings.Join(toks[2:], " ")
+	}
+
+	if err := c.closeGracefully(statusCode, reason); err != nil {
+		wsdogLogger.Errorf("write close frame to connection %d failed: %s", c.id, err)
+	}
+}
+
+func (s *ServerConsole) ping(parameter string) {
+	c, ok := s.findConn(strings.TrimSpace(parameter))
+	if !ok {
+		return
+	}
+	if err := c.writeControl(websocket.PingMessage, nil); err != nil {
+		wsdogLogger.Errorf("write ping frame to connection %d failed: %s", c.id, err)
+	}
+}
+
+func (s *ServerConsole) execute(input string) {
+	cmd, err := parseConsoleCommand(input, true)
+	if err != nil {
+		wsdogLogger.Errorf("invalid slash command. %s", err.Error())
+		return
+	}
+
+	switch cmd.command {
+	case TextCommand:
+		s.broadcast(cmd.parameter)
+	case ToCommand:
+		s.sendTo(cmd.parameter)
+	case ListCommand:
+		s.listConns()
+	case KickCommand:
+		s.kick(cmd.parameter)
+	case PingCommand:
+		s.ping(cmd.parameter)
+	default:
+		if s.proxy == nil || !s.proxy.execute(cmd) {
+			wsdogLogger.Errorf("unknown slash command: \"%s\"", cmd.command)
+		}
+	}
+}
+
+// loop reads lines from console until the user quits. Logs are written through the
+// console so they do not mess up the line being typed.
+func (s *ServerConsole) loop() {
+	consoleReader := NewConsoleInputReader()
+	defer consoleReader.Close()
+
+	originalOutput := color.Output
+	color.Output = consoleReader.reader.Stdout()
+	defer func() { color.Output = originalOutput }()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-consoleReader.done:
+			return
+		case output := <-consoleReader.outputChan:
+			if len(output) > 0 {
+				s.execute(output)
+			}
+		case <-interrupt:
+			return
+		}
+	}
+}
+
+func isConsoleAvailable() bool {
+	return readline.DefaultIsTerminal()
+}
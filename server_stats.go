@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpcodeCounters counts the messages of an opcode and the bytes of their payloads in each direction.
+type OpcodeCounters struct {
+	MessagesIn  uint64 `json:"messages_in"`
+	BytesIn     uint64 `json:"bytes_in"`
+	MessagesOut uint64 `json:"messages_out"`
+	BytesOut    uint64 `json:"bytes_out"`
+}
+
+// TrafficCounters are OpcodeCounters by opcode names like "text" or "ping".
+type TrafficCounters map[string]*OpcodeCounters
+
+func (t TrafficCounters) add(messageType int, payload []byte, in bool) {
+	opcode := opcodeName(messageType)
+	counters, ok := t[opcode]
+	if !ok {
+		counters = &OpcodeCounters{}
+		t[opcode] = counters
+	}
+	if in {
+		counters.MessagesIn++
+		counters.BytesIn += uint64(len(payload))
+	} else {
+		counters.MessagesOut++
+		counters.BytesOut += uint64(len(payload))
+	}
+}
+
+func (t TrafficCounters) opcodes() []string {
+	opcodes := make([]string, 0, len(t))
+	for opcode := range t {
+		opcodes = append(opcodes, opcode)
+	}
+	sort.Strings(opcodes)
+	return opcodes
+}
+
+// ConnStats is the traffic of a connection in listen mode.
+type ConnStats struct {
+	Id          uint64          `json:"id"`
+	RemoteAddr  string          `json:"remote"`
+	ConnectedAt time.Time       `json:"connected_at"`
+	Traffic     TrafficCounters `json:"traffic"`
+}
+
+// ServerStats is an EventSink which counts the connections and the traffic in listen mode,
+// both for each alive connection and for all the connections since the server started.
+type ServerStats struct {
+	mu         sync.Mutex
+	startedAt  time.Time
+	opened     uint64
+	closed     uint64
+	closeCodes map[int]uint64
+	traffic    TrafficCounters
+	conns      map[uint64]*ConnStats
+}
+
+func NewServerStats() *ServerStats {
+	return &ServerStats{
+		startedAt:  time.Now(),
+		closeCodes: make(map[int]uint64),
+		traffic:    make(TrafficCounters),
+		conns:      make(map[uint64]*ConnStats),
+	}
+}
+
+func (s *ServerStats) Connected(connId uint64, remoteAddr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opened++
+	s.conns[connId] = &ConnStats{Id: connId, RemoteAddr: remoteAddr, ConnectedAt: time.Now(), Traffic: make(TrafficCounters)}
+}
+
+// Disconnected counts the close code if the connection was closed by the client or dropped.
+// The code is 0 if the connection was closed by wsdog, and it's not counted.
+func (s *ServerStats) Disconnected(connId uint64, code int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[connId]; !ok {
+		return
+	}
+	s.closed++
+	if code != 0 {
+		s.closeCodes[code]++
+	}
+	delete(s.conns, connId)
+}
+
+func (s *ServerStats) count(connId uint64, messageType int, payload []byte, in bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traffic.add(messageType, payload, in)
+	if conn, ok := s.conns[connId]; ok {
+		conn.Traffic.add(messageType, payload, in)
+	}
+}
+
+func (s *ServerStats) Received(connId uint64, messageType int, payload []byte) {
+	s.count(connId, messageType, payload, true)
+}
+
+func (s *ServerStats) Sent(connId uint64, messageType int, payload []byte) {
+	s.count(connId, messageType, payload, false)
+}
+
+// Injected counts the message like the ones forwarded in the same direction.
+func (s *ServerStats) Injected(connId uint64, toClient bool, messageType int, payload []byte) {
+	s.count(connId, messageType, payload, !toClient)
+}
+
+func (s *ServerStats) sortedConns() []*ConnStats {
+	conns := make([]*ConnStats, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Id < conns[j].Id })
+	return conns
+}
+
+func (s *ServerStats) sortedCloseCodes() []int {
+	codes := make([]int, 0, len(s.closeCodes))
+	for code := range s.closeCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// ServeHTTP writes the stats in Prometheus text format, or in JSON if the query has format=json.
+func (s *ServerStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		s.writeJson(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writePrometheus(w)
+}
+
+func (s *ServerStats) writeJson(w io.Writer) {
+	closeCodes := make(map[string]uint64, len(s.closeCodes))
+	for code, count := range s.closeCodes {
+		closeCodes[fmt.Sprintf("%d", code)] = count
+	}
+	stats := struct {
+		StartedAt   time.Time         `json:"started_at"`
+		Opened      uint64            `json:"connections_opened"`
+		Closed      uint64            `json:"connections_closed"`
+		Active      int               `json:"connections_active"`
+		CloseCodes  map[string]uint64 `json:"close_codes"`
+		Traffic     TrafficCounters   `json:"traffic"`
+		Connections []*ConnStats      `json:"connections"`
+	}{s.startedAt, s.opened, s.closed, len(s.conns), closeCodes, s.traffic, s.sortedConns()}
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		wsdogLogger.Debugf("write metrics failed: %s", err)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeTrafficMetrics writes a sample of each metric for each opcode. labels, if not empty,
+// are added to the opcode label of every sample.
+func writeTrafficMetrics(w io.Writer, name string, traffic TrafficCounters, labels string, value func(*OpcodeCounters) uint64) {
+	for _, opcode := range traffic.opcodes() {
+		_, _ = fmt.Fprintf(w, "%s{%sopcode=\"%s\"} %d\n", name, labels, opcode, value(traffic[opcode]))
+	}
+}
+
+var trafficMetrics = []struct {
+	name  string
+	help  string
+	value func(*OpcodeCounters) uint64
+}{
+	{"messages_received_total", "Messages received by opcode", func(c *OpcodeCounters) uint64 { return c.MessagesIn }},
+	{"bytes_received_total", "Payload bytes of the messages received by opcode", func(c *OpcodeCounters) uint64 { return c.BytesIn }},
+	{"messages_sent_total", "Messages sent by opcode", func(c *OpcodeCounters) uint64 { return c.MessagesOut }},
+	{"bytes_sent_total", "Payload bytes of the messages sent by opcode", func(c *OpcodeCounters) uint64 { return c.BytesOut }},
+}
+
+func (s *ServerStats) writePrometheus(w io.Writer) {
+	writeMetricHeader(w, "wsdog_connections_opened_total", "counter", "Connections accepted.")
+	_, _ = fmt.Fprintf(w, "wsdog_connections_opened_total %d\n", s.opened)
+	writeMetricHeader(w, "wsdog_connections_closed_total", "counter", "Connections closed.")
+	_, _ = fmt.Fprintf(w, "wsdog_connections_closed_total %d\n", s.closed)
+	writeMetricHeader(w, "wsdog_connections_active", "gauge", "Connections alive.")
+	_, _ = fmt.Fprintf(w, "wsdog_connections_active %d\n", len(s.conns))
+
+	writeMetricHeader(w, "wsdog_close_codes_total", "counter", "Close codes received from clients, 1006 for dropped connections.")
+	for _, code := range s.sortedCloseCodes() {
+		_, _ = fmt.Fprintf(w, "wsdog_close_codes_total{code=\"%d\"} %d\n", code, s.closeCodes[code])
+	}
+
+	conns := s.sortedConns()
+	for _, metric := range trafficMetrics {
+		writeMetricHeader(w, "wsdog_"+metric.name, "counter", metric.help+".")
+		writeTrafficMetrics(w, "wsdog_"+metric.name, s.traffic, "", metric.value)
+
+		name := "wsdog_connection_" + metric.name
+		writeMetricHeader(w, name, "counter", metric.help+" on each alive connection.")
+		for _, c := range conns {
+			writeTrafficMetrics(w, name, c.Traffic, fmt.Sprintf("conn=\"%d\",", c.Id), metric.value)
+		}
+	}
+}
+
+// printSummary prints the stats since the server started.
+func (s *ServerStats) printSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wsdogLogger.Okf("Served for %s", time.Since(s.startedAt).Round(time.Second))
+	wsdogLogger.Okf("Connections: %d opened, %d closed, %d active", s.opened, s.closed, len(s.conns))
+	for _, opcode := range s.traffic.opcodes() {
+		c := s.traffic[opcode]
+		wsdogLogger.Okf("%s: %d received (%d bytes), %d sent (%d bytes)", opcode, c.MessagesIn, c.BytesIn, c.MessagesOut, c.BytesOut)
+	}
+	if len(s.closeCodes) > 0 {
+		var descriptions []string
+		for _, code := range s.sortedCloseCodes() {
+			descriptions = append(descriptions, fmt.Sprintf("%d x %d", s.closeCodes[code], code))
+		}
+		wsdogLogger.Okf("Close codes: %s", strings.Join(descriptions, ", "))
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestMetricsPathShadows(t *testing.T) {
+	tests := []struct {
+		metricsPath string
+		path        string
+		want        bool
+	}{
+		{"/metrics", "/metrics", true},
+		{"/metrics", "/metrics/conns", false},
+		{"/metrics", "/echo", false},
+		{"/metrics/", "/metrics/", true},
+		{"/metrics/", "/metrics/conns", true},
+		{"/metrics/", "/metrics", false},
+	}
+	for _, test := range tests {
+		if got := metricsPathShadows(test.metricsPath, test.path); got != test.want {
+			t.Errorf("metricsPathShadows(%q, %q) = %v, want %v", test.metricsPath, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// subprotocolList returns the subprotocols given by --subprotocol in preference order. Each
+// value of the option can be a single subprotocol or a comma separated list of them.
+func subprotocolList(opts CommandLineOptions) []string {
+	var protocols []string
+	for _, value := range opts.Subprotocol {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); len(protocol) > 0 {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// selectSubprotocol returns the first subprotocol in the server's list of preference which is
+// also requested by the client, like the websocket library does when it upgrades a connection.
+func selectSubprotocol(supported []string, req *http.Request) string {
+	for _, supportedProtocol := range supported {
+		for _, requestedProtocol := range requestedSubprotocols(req.Header) {
+			if requestedProtocol == supportedProtocol {
+				return supportedProtocol
+			}
+		}
+	}
+	return ""
+}
+
+func requestedSubprotocols(header http.Header) []string {
+	var protocols []string
+	for _, value := range header.Values(subprotocolHeader) {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); len(protocol) > 0 {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// checkResponseSubprotocol returns the subprotocol chosen by the server. It's an error if the
+// server chose a subprotocol not requested, or chose none when strict is true.
+func checkResponseSubprotocol(requested []string, strict bool, resp *http.Response) (string, error) {
+	chosen := resp.Header.Get(subprotocolHeader)
+	if len(chosen) == 0 {
+		if strict {
+			return "", fmt.Errorf("server chose none of the subprotocols: %s", strings.Join(requested, ", "))
+		}
+		return "", nil
+	}
+	for _, protocol := range requested {
+		if protocol == chosen {
+			return chosen, nil
+		}
+	}
+	return "", fmt.Errorf("server chose subprotocol \"%s\" which was not requested", chosen)
+}
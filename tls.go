@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/youmark/pkcs8"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+	"time"
+)
+
+// passphraseProvider returns the passphrase used to decrypt private keys and PKCS#12 bundles.
+// It only asks the user on the console the first time it's needed and remembers the answer.
+type passphraseProvider struct {
+	passphrase string
+	resolved   bool
+	prompt     string
+}
+
+func newPassphraseProvider(passphrase string, prompt string) *passphraseProvider {
+	return &passphraseProvider{passphrase: passphrase, resolved: len(passphrase) > 0, prompt: prompt}
+}
+
+func (p *passphraseProvider) get() (string, error) {
+	if p.resolved {
+		return p.passphrase, nil
+	}
+
+	passphrase, err := ReadPassphraseFromConsole(p.prompt)
+	if err != nil {
+		return "", fmt.Errorf("read passphrase failed: %s", err)
+	}
+	p.passphrase = passphrase
+	p.resolved = true
+	return passphrase, nil
+}
+
+func isPkcs12File(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".p12", ".pfx":
+		return true
+	}
+	return false
+}
+
+func isPemData(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil
+}
+
+// decodePkcs12 decodes a PKCS#12 bundle. An empty password is tried first so
+// unprotected bundles never trigger a prompt.
+func decodePkcs12(data []byte, passphrase *passphraseProvider) (crypto.PrivateKey, *x509.Certificate, []*x509.Certificate, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, "")
+	if err == nil {
+		return key, cert, caCerts, nil
+	}
+	if err != pkcs12.ErrIncorrectPassword {
+		return nil, nil, nil, err
+	}
+
+	password, err := passphrase.get()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pkcs12.DecodeChain(data, password)
+}
+
+func decodePkcs12TrustStore(data []byte, passphrase *passphraseProvider) ([]*x509.Certificate, error) {
+	certs, err := pkcs12.DecodeTrustStore(data, "")
+	if err == pkcs12.ErrIncorrectPassword {
+		var password string
+		if password, err = passphrase.get(); err != nil {
+			return nil, err
+		}
+		certs, err = pkcs12.DecodeTrustStore(data, password)
+	}
+	if err == nil {
+		return certs, nil
+	}
+
+	// not a trust store, maybe a bundle with a key and its certificate chain
+	_, cert, caCerts, err := decodePkcs12(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return append(caCerts, cert), nil
+}
+
+func loadCertPool(path string, passphrase *passphraseProvider) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file \"%s\" failed: %s", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if isPemData(data) {
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid certificate found in CA file \"%s\"", path)
+		}
+		return pool, nil
+	}
+
+	certs, err := decodePkcs12TrustStore(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA file \"%s\" failed: %s", path, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no valid certificate found in CA file \"%s\"", path)
+	}
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, errors.New("unknown private key type in PKCS#8 wrapping")
+		}
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+func decodePemPrivateKey(data []byte, passphrase *passphraseProvider) (crypto.PrivateKey, error) {
+	var block *pem.Block
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		if block.Type == "PRIVATE KEY" || block.Type == "ENCRYPTED PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			break
+		}
+	}
+
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		password, err := passphrase.get()
+		if err != nil {
+			return nil, err
+		}
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key failed, maybe the passphrase is wrong: %s", err)
+		}
+		return key, nil
+	}
+
+	// legacy encrypted PEM keys like the ones produced by "openssl rsa -aes256"
+	if x509.IsEncryptedPEMBlock(block) {
+		password, err := passphrase.get()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key failed, maybe the passphrase is wrong: %s", err)
+		}
+		return parsePrivateKey(der)
+	}
+
+	return parsePrivateKey(block.Bytes)
+}
+
+func decodePemCertificates(data []byte) ([][]byte, error) {
+	var certs [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// loadCertificate loads a certificate with its private key. The certificate can be
+// a PEM file, a PKCS#12 bundle containing the key or a PEM file containing both the
+// certificate and the key, in which case keyPath can be empty.
+func loadCertificate(certPath string, keyPath string, passphrase *passphraseProvider) (tls.Certificate, error) {
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read certificate file \"%s\" failed: %s", certPath, err)
+	}
+
+	if isPkcs12File(certPath) || !isPemData(certData) {
+		key, cert, caCerts, err := decodePkcs12(certData, passphrase)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("parse PKCS#12 bundle \"%s\" failed: %s", certPath, err)
+		}
+		tlsCert := tls.Certificate{PrivateKey: key, Leaf: cert}
+		tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+		for _, c := range caCerts {
+			tlsCert.Certificate = append(tlsCert.Certificate, c.Raw)
+		}
+		return tlsCert, nil
+	}
+
+	certs, err := decodePemCertificates(certData)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse certificate file \"%s\" failed: %s", certPath, err)
+	}
+
+	keyData := certData
+	if len(keyPath) > 0 {
+		if keyData, err = ioutil.ReadFile(keyPath); err != nil {
+			return tls.Certificate{}, fmt.Errorf("read key file \"%s\" failed: %s", keyPath, err)
+		}
+	}
+	key, err := decodePemPrivateKey(keyData, passphrase)
+	if err != nil {
+		if len(keyPath) == 0 {
+			return tls.Certificate{}, fmt.Errorf("parse private key in \"%s\" failed: %s, please provide it with --key", certPath, err)
+		}
+		return tls.Certificate{}, fmt.Errorf("parse key file \"%s\" failed: %s", keyPath, err)
+	}
+
+	leaf, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse certificate file \"%s\" failed: %s", certPath, err)
+	}
+	if err := checkKeyMatchesCertificate(key, leaf); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: certs, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func checkKeyMatchesCertificate(key crypto.PrivateKey, cert *x509.Certificate) error {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.New("private key is not usable for signing")
+	}
+	type publicKey interface {
+		Equal(x crypto.PublicKey) bool
+	}
+	pub, ok := signer.Public().(publicKey)
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return errors.New("private key does not match the certificate")
+	}
+	return nil
+}
+
+func newClientTlsConfig(cliOpts CommandLineOptions) (*tls.Config, error) {
+	var tlsConfig = tls.Config{}
+	if cliOpts.NoTlsCheck {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	passphrase := newPassphraseProvider(cliOpts.Passphrase, "Passphrase: ")
+	if len(cliOpts.Ca) > 0 {
+		pool, err := loadCertPool(cliOpts.Ca, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cliOpts.Cert) > 0 {
+		cert, err := loadCertificate(cliOpts.Cert, cliOpts.Key, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if len(cliOpts.Key) > 0 {
+		return nil, errors.New("--key requires a client certificate provided by --cert")
+	}
+	return &tlsConfig, nil
+}
+
+// describeTlsError turns certificate verification failures into a hint about which option may help.
+func describeTlsError(err error) string {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthorityErr):
+		subject := "unknown"
+		if unknownAuthorityErr.Cert != nil {
+			subject = unknownAuthorityErr.Cert.Subject.String()
+		}
+		return fmt.Sprintf("server certificate \"%s\" is signed by an unknown authority, use --ca to trust it or -n to skip the check", subject)
+	case errors.As(err, &hostnameErr):
+		return fmt.Sprintf("server certificate is not valid for host \"%s\", use -n to skip the check", hostnameErr.Host)
+	case errors.As(err, &invalidErr):
+		return fmt.Sprintf("server certificate is invalid: %s", invalidErr.Error())
+	}
+	return err.Error()
+}
+
+// generateSelfSignedCertificate creates a throwaway certificate valid for the given host names and IP addresses.
+func generateSelfSignedCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate private key failed: %s", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate serial number failed: %s", err)
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"wsdog"}, CommonName: hosts[0]},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(defaultSelfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate failed: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse generated certificate failed: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of a certificate in the colon separated form openssl prints.
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+// newServerTlsConfig returns nil when the server should listen without TLS.
+func newServerTlsConfig(opts CommandLineOptions) (*tls.Config, error) {
+	if len(opts.ListenCert) > 0 && len(opts.SelfSignedHosts) > 0 {
+		return nil, errors.New("--listen-cert and --self-signed can not be used together")
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case len(opts.ListenCert) > 0:
+		passphrase := newPassphraseProvider(opts.ListenPassphrase, "Passphrase: ")
+		if cert, err = loadCertificate(opts.ListenCert, opts.ListenKey, passphrase); err != nil {
+			return nil, err
+		}
+	case len(opts.SelfSignedHosts) > 0:
+		if cert, err = generateSelfSignedCertificate(opts.SelfSignedHosts); err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate failed: %s", err)
+		}
+		wsdogLogger.Okf("Generated self-signed certificate for %s", strings.Join(opts.SelfSignedHosts, ", "))
+		wsdogLogger.Okf("SHA-256 fingerprint: %s", certificateFingerprint(cert.Leaf))
+	case len(opts.ListenKey) > 0:
+		return nil, errors.New("--listen-key requires a certificate provided by --listen-cert")
+	default:
+		return nil, nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/base64"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"net"
 	"time"
@@ -10,12 +10,23 @@ import (
 type WebSocketMessage struct {
 	messageType int
 	payload     []byte
+	// wireStats is set only when the frames of the connection are sniffed
+	wireStats *MessageWireStats
 }
 
-func setupPingPongHandler(conn *websocket.Conn, output chan WebSocketMessage) {
+// setupPingPongHandler reports ping and pong frames as events, and prints a notification
+// for each one of them when showPingPong is true. Pongs extend the read deadline of keepalive if it's not nil.
+func setupPingPongHandler(conn *websocket.Conn, connId uint64, showPingPong bool, keepalive *Keepalive, output chan WebSocketMessage) {
+	prefix := connPrefix(connId)
 	pingHandler := func(message string) error {
-		wsdogLogger.Ok("Receive Ping frame")
+		if showPingPong {
+			wsdogLogger.Okf("%sReceive Ping frame", prefix)
+		}
+		wsdogEvents.Received(connId, websocket.PingMessage, []byte(message))
 		err := conn.WriteControl(websocket.PongMessage, []byte(message), time.Now().Add(defaultWriteWaitDuration))
+		if err == nil {
+			wsdogEvents.Sent(connId, websocket.PongMessage, []byte(message))
+		}
 		if err == websocket.ErrCloseSent {
 			return nil
 		} else if e, ok := err.(net.Error); ok && e.Temporary() {
@@ -25,7 +36,17 @@ func setupPingPongHandler(conn *websocket.Conn, output chan WebSocketMessage) {
 	}
 
 	pongHandler := func(message string) error {
-		wsdogLogger.Ok("Receive Pong frame")
+		if showPingPong {
+			if rtt, ok := keepaliveRoundTripTime(message); ok {
+				wsdogLogger.Okf("%sReceive Pong frame (RTT: %s)", prefix, rtt)
+			} else {
+				wsdogLogger.Okf("%sReceive Pong frame", prefix)
+			}
+		}
+		wsdogEvents.Received(connId, websocket.PongMessage, []byte(message))
+		if keepalive != nil {
+			return keepalive.extendReadDeadline(conn)
+		}
 		return nil
 	}
 
@@ -33,40 +54,84 @@ func setupPingPongHandler(conn *websocket.Conn, output chan WebSocketMessage) {
 	conn.SetPongHandler(pongHandler)
 }
 
-func setupCloseHandler(conn *websocket.Conn) {
+func setupCloseHandler(conn *websocket.Conn, connId uint64) {
+	prefix := connPrefix(connId)
 	conn.SetCloseHandler(func(code int, text string) error {
-		wsdogLogger.Okf("Receive close frame (code: %d, reason %s)", code, text)
+		wsdogLogger.Okf("%sReceive close frame (code: %d, reason %s)", prefix, code, text)
+		wsdogEvents.Received(connId, websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
 		return &websocket.CloseError{Code: code, Text: text}
 	})
 }
 
-func SetupReadFromConn(conn *websocket.Conn, showPingPong bool) (chan WebSocketMessage, chan struct{}) {
+// SetupReadFromConn starts reading from the connection. closeListener, if it's not nil, is called
+// with the close code when the connection is closed by the peer or dropped unexpectedly.
+// connId identifies the connection in events, it's 0 for the connection of the client.
+// keepalive, if it's not nil, pings the peer until the returned done channel is closed.
+func SetupReadFromConn(conn *websocket.Conn, connId uint64, showPingPong bool, keepalive *Keepalive, closeListener func(code int, text string)) (chan WebSocketMessage, chan struct{}) {
 	done := make(chan struct{})
 	output := make(chan WebSocketMessage)
-	if showPingPong {
-		setupPingPongHandler(conn, output)
+	setupPingPongHandler(conn, connId, showPingPong, keepalive, output)
+	setupCloseHandler(conn, connId)
+	if keepalive != nil {
+		if err := keepalive.extendReadDeadline(conn); err != nil {
+			wsdogLogger.Debugf("set read deadline failed: %s", err)
+		}
+		keepalive.start(conn, connId, done)
+	}
+	sniffer, _ := frameSnifferOf(conn)
+	// the connection may be unregistered in listen mode by the time it's reported as disconnected
+	prefix := connPrefix(connId)
+	// disconnected logs and reports the end of the connection with the description. code is 0 if the
+	// connection was closed by closing done, otherwise closeListener is called too.
+	disconnected := func(code int, reason string, description string) {
+		wsdogLogger.Okf("%sDisconnected%s", prefix, description)
+		wsdogEvents.Disconnected(connId, code, reason)
+		if code != 0 && closeListener != nil {
+			closeListener(code, reason)
+		}
 	}
-	setupCloseHandler(conn)
 	go func() {
 		defer close(output)
 		for {
 			select {
-			case <- done:
-				wsdogLogger.Okf("Disconnected")
+			case <-done:
+				disconnected(0, "", "")
 				return
 			default:
 				mt, message, err := conn.ReadMessage()
 				if err != nil {
 					closeErr, ok := err.(*websocket.CloseError)
 					if ok {
-						wsdogLogger.Okf("Disconnected (code: %d, reason: \"%s\")", closeErr.Code, closeErr.Text)
+						disconnected(closeErr.Code, closeErr.Text, fmt.Sprintf(" (code: %d, reason: \"%s\")", closeErr.Code, closeErr.Text))
 						return
-					} else {
-						wsdogLogger.Debugf("error: %s", err.Error())
-						continue
+					}
+
+					netErr, isNetErr := err.(net.Error)
+					select {
+					case <-done:
+						disconnected(0, "", "")
+					default:
+						reason := err.Error()
+						if isNetErr && netErr.Timeout() {
+							// read deadline is only set by keepalive, which extends it on each pong
+							reason = "no pong received in time"
+						}
+						disconnected(websocket.CloseAbnormalClosure, reason, fmt.Sprintf(" (error: %s)", reason))
+					}
+					return
+				}
+				var wireStats *MessageWireStats
+				if sniffer != nil {
+					if stats, ok := sniffer.popMessage(); ok {
+						wireStats = &stats
 					}
 				}
-				output <- WebSocketMessage{mt, message}
+				select {
+				case output <- WebSocketMessage{mt, message, wireStats}:
+				case <-done:
+					disconnected(0, "", "")
+					return
+				}
 			}
 
 		}
@@ -75,11 +140,13 @@ func SetupReadFromConn(conn *websocket.Conn, showPingPong bool) (chan WebSocketM
 }
 
 func PrintReceivedMessage(message *WebSocketMessage) {
-	switch message.messageType {
-	case websocket.TextMessage:
-		wsdogLogger.ReceiveMessagef("< %s", message.payload)
-	case websocket.BinaryMessage:
-		sEnc := base64.StdEncoding.EncodeToString(message.payload)
-		wsdogLogger.ReceiveMessagef("<< %s", sEnc)
+	PrintReceivedMessageFromConn(0, message)
+}
+
+// PrintReceivedMessageFromConn prints a message received in listen mode along with the ID of its connection.
+func PrintReceivedMessageFromConn(connId uint64, message *WebSocketMessage) {
+	wsdogEvents.Received(connId, message.messageType, message.payload)
+	if message.wireStats != nil {
+		printWireStats(connId, message.wireStats, len(message.payload))
 	}
 }